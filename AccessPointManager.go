@@ -1,80 +1,205 @@
 package main
 
 import (
+	"fmt"
 	"io/ioutil"
-	"log"
-	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
+// the channel ap0 uses unless it is told otherwise
+const DefaultAPChannel = 6
+
 type AccessPointManager struct {
+	sync.Mutex
 	NetworkInterface string
-	HostapdJob       UpstartJob
+	HostapdJob       *Service
+	Services         ServiceManager
+	Firewall         *FirewallManager
 	config           AssistantConfig
+	country          string
+	key              string // the configured key if there is one, otherwise the generated one
+	channel          int    // the channel we'd like ap0 on, normally the one wlan0 is using
+	hostapdChannel   int    // the channel hostapd was last configured with, which differs if the country doesn't allow ours
+	active           bool   // hostapd has been started, and not stopped since
+	attached         bool   // MonitorStations is following hostapd's station events
+	stations         map[string]bool
+	stationEvents    *stateBroadcaster
+	lastActivity     time.Time // when the AP was started, or a station last came or went
+	hotspotUplink    string    // the uplink being shared with clients of the AP, if any
 }
 
 func NewAccessPointManager(config AssistantConfig) *AccessPointManager {
+	services, err := NewServiceManager(config.Services.Manager)
+	if err != nil {
+		logger.Errorf("%v, using whichever booted the sphere", err)
+		services, _ = NewServiceManager("auto")
+	}
+	return NewAccessPointManagerWithServices(config, services)
+}
+
+// NewAccessPointManagerWithServices creates a manager that starts hostapd and dnsmasq with the
+// given service manager, e.g. a FakeServiceManager
+func NewAccessPointManagerWithServices(config AssistantConfig, services ServiceManager) *AccessPointManager {
 	manager := &AccessPointManager{}
 	manager.NetworkInterface = "ap0"
-	manager.HostapdJob = UpstartJob{"hostapd-ap0"}
+	manager.Services = services
+	manager.HostapdJob = &Service{"hostapd-ap0", services}
 	manager.config = config
+	manager.Firewall = NewFirewallManager(config)
+	manager.country = LoadCountry(config)
+	manager.channel = DefaultAPChannel
+	manager.stations = make(map[string]bool)
+	manager.stationEvents = newStateBroadcaster("")
+
+	// a key in the configuration (for demo units) is used as is, otherwise each sphere has its own
+	manager.key = config.Wireless_Host.Key
+	if manager.key == "" {
+		key, err := LoadOrCreateAPKey()
+		if err != nil {
+			// still better than a shared key, even if it won't survive a restart
+			logger.Errorf("Failed to save the access point key: %v", err)
+		}
+		manager.key = key
+	}
 
 	return manager
 }
 
-func (a *AccessPointManager) StartHostAP() {
-	a.HostapdJob.Stop()
-	a.HostapdJob.Start()
+// StartHostAP (re)starts hostapd, returning once it is running
+func (a *AccessPointManager) StartHostAP() error {
+	a.Lock()
+	a.active = true
+	a.stations = make(map[string]bool)
+	a.lastActivity = time.Now()
+	a.Unlock()
+	if err := a.HostapdJob.Restart(); err != nil {
+		return fmt.Errorf("failed to start hostapd: %v", err)
+	}
+	// dnsmasq only binds to ap0, which hostapd's job creates, so it can't listen on it until now
+	if err := a.Services.Restart("dnsmasq"); err != nil {
+		return fmt.Errorf("failed to restart dnsmasq: %v", err)
+	}
+	return nil
 }
 
-func (a *AccessPointManager) StopHostAP() {
-	a.HostapdJob.Stop()
+// StopHostAP stops hostapd, returning once it has stopped
+func (a *AccessPointManager) StopHostAP() error {
+	a.Lock()
+	a.active = false
+	a.Unlock()
+	if err := a.HostapdJob.Stop(); err != nil {
+		return fmt.Errorf("failed to stop hostapd: %v", err)
+	}
+	return nil
+}
+
+// Country returns the regulatory domain ap0 is configured for
+func (a *AccessPointManager) Country() string {
+	a.Lock()
+	defer a.Unlock()
+	return a.country
+}
+
+// SetCountry rewrites the hostapd configuration for the new regulatory domain, restarting hostapd if it is running
+func (a *AccessPointManager) SetCountry(country string) error {
+	if _, err := LookupRegulatoryDomain(country); err != nil {
+		return err
+	}
+
+	a.Lock()
+	a.country = strings.ToUpper(country)
+	active := a.active
+	a.Unlock()
+
+	a.WriteAPConfig()
+	if active {
+		logger.Infof("Restarting hostapd for country %s", country)
+		return a.StartHostAP()
+	}
+	return nil
+}
+
+// apChannel returns the configured channel if the country allows an access point on it, or the
+// first channel that it does allow
+func (a *AccessPointManager) apChannel() (int, error) {
+	domain, err := LookupRegulatoryDomain(a.country)
+	if err != nil {
+		return 0, err
+	}
+	if domain.AllowsAPChannel(a.channel) {
+		return a.channel, nil
+	}
+	reason := "is not allowed"
+	if containsChannel(domain.DFS, a.channel) {
+		reason = "needs radar detection (DFS)"
+	}
+	for _, channel := range domain.Channels24 {
+		if domain.AllowsAPChannel(channel) {
+			// with a single radio, the two interfaces will fight over it
+			logger.Warningf("Channel %d %s for an access point in %s, so ap0 is on channel %d rather than wlan0's channel %d",
+				a.channel, reason, a.country, channel, a.channel)
+			return channel, nil
+		}
+	}
+	return 0, fmt.Errorf("no channels allowed for an access point in %s", a.country)
 }
 
 func (a *AccessPointManager) WriteAPConfig() {
+	a.Lock()
+	defer a.Unlock()
+
+	channel, err := a.apChannel()
+	if err != nil {
+		logger.Errorf("Failed to choose an ap channel: %v", err)
+		channel = DefaultAPChannel
+	}
+	a.hostapdChannel = channel
+
 	s := ""
 	s += "interface=ap0\n"
 	s += "driver=nl80211\n"
+	// for hostapd_cli, and for following station events
+	s += "ctrl_interface=" + HostapdControlDir + "\n"
 	s += "ssid=" + a.config.Wireless_Host.SSID + "\n"
-	s += "hw_mode=g\n"
-	s += "channel=6\n"
+	if a.country != WorldCountry {
+		s += "country_code=" + a.country + "\n"
+		s += "ieee80211d=1\n"
+	}
+	if channel > 14 {
+		s += "hw_mode=a\n"
+	} else {
+		s += "hw_mode=g\n"
+	}
+	s += "channel=" + strconv.Itoa(channel) + "\n"
 	s += "macaddr_acl=0\n"
 	s += "auth_algs=1\n"
 	s += "ignore_broadcast_ssid=0\n"
 	s += "wpa=3\n"
-	s += "wpa_passphrase=" + a.config.Wireless_Host.Key + "\n"
+	s += "wpa_passphrase=" + a.key + "\n"
 	s += "wpa_key_mgmt=WPA-PSK\n"
 	s += "wpa_pairwise=TKIP\n"
 	s += "rsn_pairwise=CCMP\n"
 	ioutil.WriteFile("/data/etc/hostapd-ap0.conf", []byte(s), 0600)
 }
 
-func (a *AccessPointManager) iptables(cmd ...string) {
-	log.Println("iptables ", cmd)
-	err := exec.Command("/sbin/iptables", cmd...).Run()
+// FirewallPolicy returns the configured firewall policy, with the rules it produces
+func (a *AccessPointManager) FirewallPolicy() (*FirewallPolicy, []FirewallRule, error) {
+	policy, err := LoadFirewallPolicy(a.config)
 	if err != nil {
-		log.Fatal("iptables failed: ", err)
+		return nil, nil, err
 	}
+	rules, err := policy.Rules()
+	return policy, rules, err
 }
 
-func (a *AccessPointManager) SetupFirewall() {
-	if a.config.Wireless_Host.Full_Network_Access {
-		a.iptables("-F")
-	} else {
-		a.iptables("-P", "INPUT", "ACCEPT")
-		a.iptables("-P", "OUTPUT", "ACCEPT")
-		a.iptables("-P", "FORWARD", "ACCEPT")
-		a.iptables("-F")
-
-		// Allow the pairing webserver to be seen from the AP
-		a.iptables("-A", "INPUT", "-i", a.NetworkInterface, "-p", "tcp", "--dport", "8888", "-j", "ACCEPT")
-		a.iptables("-A", "INPUT", "-i", a.NetworkInterface, "-p", "tcp", "--dport", "80", "-j", "ACCEPT")
-		a.iptables("-A", "INPUT", "-i", a.NetworkInterface, "-p", "tcp", "--dport", "9001", "-j", "ACCEPT")
-		a.iptables("-A", "INPUT", "-i", a.NetworkInterface, "-p", "tcp", "--dport", "22", "-j", "ACCEPT")
-
-		// Allow clients to get IP addresses from DHCP
-		a.iptables("-A", "INPUT", "-i", a.NetworkInterface, "-p", "udp", "--dport", "67:68", "-j", "ACCEPT")
-
-		// allow nothing on here. before doing this, we will eventually allow setup access on one port.
-		a.iptables("-A", "INPUT", "-i", a.NetworkInterface, "-j", "DROP")
+// SetupFirewall brings the assistant's firewall rules up to date, without touching anyone else's
+func (a *AccessPointManager) SetupFirewall() error {
+	_, rules, err := a.FirewallPolicy()
+	if err != nil {
+		return err
 	}
+	return a.Firewall.Apply(rules)
 }
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the uplinks we can be online through, in order of preference
+const (
+	UplinkEthernet = "ethernet"
+	UplinkWifi     = "wifi"
+	UplinkNone     = "none"
+)
+
+// ifplugd watches eth0..eth19 for hotplugged adapters, so we do too
+const WiredInterfaceCount = 20
+
+// how often we look at the carrier and addresses of the wired interfaces
+const WiredPollInterval = time.Second * 2
+
+// UplinkStatus is reported to the app by /status and get_uplink
+type UplinkStatus struct {
+	Uplink    string `json:"uplink"` // one of the Uplink* constants
+	Interface string `json:"interface,omitempty"`
+	Address   string `json:"address,omitempty"`
+}
+
+// ConnectivityMonitor tracks the wired interfaces alongside wlan0, and decides which one (if any)
+// is getting us online. The uplink is emitted as a state whenever it changes.
+type ConnectivityMonitor struct {
+	sync.Mutex
+	wifi   *WifiManager
+	probe  ReachabilityProbe
+	wired  []string
+	states *stateBroadcaster
+
+	wiredIface  string // the wired interface with carrier and an address, if any
+	wiredIP     string
+	wiredOnline bool
+	status      UplinkStatus
+}
+
+func NewConnectivityMonitor(wifi *WifiManager, config AssistantConfig) *ConnectivityMonitor {
+	monitor := &ConnectivityMonitor{
+		wifi:   wifi,
+		probe:  NewReachabilityProbe(config),
+		states: newStateBroadcaster(UplinkNone),
+		status: UplinkStatus{Uplink: UplinkNone},
+	}
+	for i := 0; i < WiredInterfaceCount; i++ {
+		monitor.wired = append(monitor.wired, fmt.Sprintf("eth%d", i))
+	}
+
+	// look at the wired interfaces once up front, so that an ethernet uplink is known before
+	// main decides whether to start pairing
+	monitor.pollWired(true)
+	monitor.update()
+
+	go monitor.loop()
+
+	return monitor
+}
+
+// SubscribeUplink returns a subscription to the uplink changes (one of the Uplink* constants)
+func (c *ConnectivityMonitor) SubscribeUplink(opts SubscribeOptions) *StateSubscription {
+	return c.states.Subscribe(opts)
+}
+
+// Uplink returns the uplink in use
+func (c *ConnectivityMonitor) Uplink() UplinkStatus {
+	c.Lock()
+	defer c.Unlock()
+	return c.status
+}
+
+// IsOnline returns true if we're online through any uplink
+func (c *ConnectivityMonitor) IsOnline() bool {
+	return c.Uplink().Uplink != UplinkNone
+}
+
+func (c *ConnectivityMonitor) loop() {
+	wifiStates := c.wifi.SubscribeState(SubscribeOptions{Policy: Coalesce, NoReplay: true})
+	defer wifiStates.Unsubscribe()
+
+	ticker := time.NewTicker(WiredPollInterval)
+	defer ticker.Stop()
+
+	var lastProbe time.Time
+
+	for {
+		select {
+		case <-wifiStates.C:
+		case <-ticker.C:
+			if c.pollWired(time.Since(lastProbe) >= c.probe.Interval) {
+				lastProbe = time.Now()
+			}
+		}
+		c.update()
+	}
+}
+
+// pollWired finds the first wired interface with carrier and an address, probing through it if it
+// changed or probe is set. Returns true if it probed.
+func (c *ConnectivityMonitor) pollWired(probe bool) bool {
+	iface, ip := "", ""
+	for _, name := range c.wired {
+		if !hasCarrier(name) {
+			continue
+		}
+		if address, err := GetInterfaceAddress(name); err == nil {
+			iface, ip = name, address
+			break
+		}
+	}
+
+	c.Lock()
+	changed := iface != c.wiredIface || ip != c.wiredIP
+	if changed {
+		if iface == "" {
+			logger.Infof("ConnectivityMonitor: no wired link")
+		} else {
+			logger.Infof("ConnectivityMonitor: wired link on %s with address %s", iface, ip)
+		}
+		c.wiredIface, c.wiredIP, c.wiredOnline = iface, ip, false
+	}
+	c.Unlock()
+
+	if iface == "" || !(changed || probe) {
+		return false
+	}
+
+	// the probe isn't bound to the interface, but with a wired address the default route is
+	// normally through it
+	reachable := c.probe.Reachable()
+
+	c.Lock()
+	if c.wiredIface == iface && c.wiredIP == ip {
+		c.wiredOnline = reachable
+	}
+	c.Unlock()
+
+	return true
+}
+
+// update works out the uplink in use and emits it if it changed
+func (c *ConnectivityMonitor) update() {
+	c.Lock()
+
+	status := UplinkStatus{Uplink: UplinkNone}
+	if c.wiredOnline {
+		status = UplinkStatus{UplinkEthernet, c.wiredIface, c.wiredIP}
+	} else if c.wifi.IsOnline() {
+		ip, _ := c.wifi.Address()
+		status = UplinkStatus{UplinkWifi, WirelessNetworkInterface, ip}
+	}
+
+	changed := status != c.status
+	c.status = status
+	c.Unlock()
+
+	if changed {
+		logger.Infof("ConnectivityMonitor: uplink is now %+v", status)
+		c.states.Emit(status.Uplink)
+	}
+}
+
+// hasCarrier returns true if the named interface exists and has a link
+func hasCarrier(name string) bool {
+	carrier, err := ioutil.ReadFile("/sys/class/net/" + name + "/carrier")
+	if err != nil {
+		// missing, or down (reading carrier fails on an interface that is down)
+		return false
+	}
+	return strings.TrimSpace(string(carrier)) == "1"
+}
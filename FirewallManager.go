@@ -0,0 +1,216 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+const (
+	FirewallAccept = "accept"
+	FirewallDrop   = "drop"
+
+	// the connection tracking states of replies to connections the sphere made
+	FirewallEstablished = "established,related"
+)
+
+// FirewallRule is an input rule, in terms that both backends can render
+type FirewallRule struct {
+	Interface string // the input interface, empty for any
+	Source    string // the source address range (cidr), empty for any
+	Protocol  string // "tcp" or "udp", empty for any
+	Ports     string // a destination port, or a range like "67:68". requires a protocol.
+	State     string // connection tracking states, e.g. FirewallEstablished, empty for any
+	Action    string // FirewallAccept or FirewallDrop
+}
+
+func (r FirewallRule) String() string {
+	s := r.Action
+	if r.Interface != "" {
+		s += " on " + r.Interface
+	}
+	if r.Source != "" {
+		s += " from " + r.Source
+	}
+	if r.Protocol != "" {
+		s += " " + r.Protocol
+	}
+	if r.Ports != "" {
+		s += " port " + r.Ports
+	}
+	if r.State != "" {
+		s += " " + r.State
+	}
+	return s
+}
+
+// NATRules share an uplink with the clients on another interface
+type NATRules struct {
+	Inside  string   // the interface the clients are on
+	Outside string   // the uplink
+	Source  string   // the clients' address range (cidr)
+	Allow   []string // the mac addresses allowed through, empty for everyone
+}
+
+// FirewallBackend installs the assistant's rules in a chain (or table) of its own, leaving
+// everyone else's rules alone
+type FirewallBackend interface {
+	Name() string
+	// Render returns the rules as the backend will list them once applied
+	Render(rules []FirewallRule) []string
+	// Current returns the rules that are installed now
+	Current() ([]string, error)
+	// Apply atomically replaces the installed rules
+	Apply(rules []FirewallRule) error
+	// ApplyNAT atomically replaces the installed forwarding and masquerading rules
+	ApplyNAT(nat NATRules) error
+	// RemoveNAT removes the forwarding and masquerading rules, if there are any
+	RemoveNAT() error
+}
+
+// FirewallManager applies rule sets, only touching the firewall when the installed rules differ
+type FirewallManager struct {
+	Backend  FirewallBackend
+	DryRun   bool            // print the plan instead of applying it
+	Out      io.Writer       // where the plan is printed
+	err      error           // why there is no backend
+	renderer FirewallBackend // renders the plan when there is no backend, e.g. on a development machine
+}
+
+func NewFirewallManager(config AssistantConfig) *FirewallManager {
+	backend, err := newFirewallBackend(config.Firewall.Backend)
+	renderer := backend
+	if err != nil {
+		logger.Errorf("No firewall backend: %v", err)
+		renderer, _ = newFirewallRenderer(config.Firewall.Backend)
+	}
+	return &FirewallManager{
+		Backend:  backend,
+		Out:      os.Stdout,
+		err:      err,
+		renderer: renderer,
+	}
+}
+
+// Apply makes the installed rules match the given ones
+func (f *FirewallManager) Apply(rules []FirewallRule) error {
+	if f.Backend == nil && !(f.DryRun && f.renderer != nil) {
+		return f.err
+	}
+
+	var current []string
+	if f.Backend != nil {
+		var err error
+		if current, err = f.Backend.Current(); err != nil {
+			// most likely our chain doesn't exist yet
+			logger.Debugf("Could not list the current %s rules: %v", f.Backend.Name(), err)
+			current = nil
+		}
+	}
+
+	if f.DryRun {
+		desired := f.renderer.Render(rules)
+		added, removed := diffRules(current, desired)
+		fmt.Fprintf(f.Out, "# %s rules\n", f.renderer.Name())
+		for _, rule := range desired {
+			fmt.Fprintf(f.Out, "%s\n", rule)
+		}
+		fmt.Fprintf(f.Out, "# changes\n")
+		for _, rule := range removed {
+			fmt.Fprintf(f.Out, "- %s\n", rule)
+		}
+		for _, rule := range added {
+			fmt.Fprintf(f.Out, "+ %s\n", rule)
+		}
+		if f.Backend == nil {
+			fmt.Fprintf(f.Out, "# %s is not installed (%v), so the changes are from no rules\n", f.renderer.Name(), f.err)
+		} else if sameRules(current, desired) {
+			fmt.Fprintf(f.Out, "# up to date\n")
+		}
+		return nil
+	}
+
+	desired := f.Backend.Render(rules)
+	added, removed := diffRules(current, desired)
+	if sameRules(current, desired) {
+		logger.Infof("Firewall rules are up to date")
+		return nil
+	}
+
+	logger.Infof("Applying %d %s rules (%d added, %d removed)", len(desired), f.Backend.Name(), len(added), len(removed))
+	if err := f.Backend.Apply(rules); err != nil {
+		return fmt.Errorf("failed to apply %s rules: %v", f.Backend.Name(), err)
+	}
+	return nil
+}
+
+// ApplyNAT shares an uplink, replacing any previous NAT rules
+func (f *FirewallManager) ApplyNAT(nat NATRules) error {
+	if f.Backend == nil {
+		return f.err
+	}
+	logger.Infof("Sharing %s with %s through %s", nat.Outside, nat.Inside, f.Backend.Name())
+	if err := f.Backend.ApplyNAT(nat); err != nil {
+		return fmt.Errorf("failed to apply %s nat rules: %v", f.Backend.Name(), err)
+	}
+	return nil
+}
+
+// RemoveNAT stops sharing the uplink
+func (f *FirewallManager) RemoveNAT() error {
+	if f.Backend == nil {
+		// without a backend there can't be any rules
+		return nil
+	}
+	if err := f.Backend.RemoveNAT(); err != nil {
+		return fmt.Errorf("failed to remove %s nat rules: %v", f.Backend.Name(), err)
+	}
+	return nil
+}
+
+// sameRules compares rule lists, in order, as order matters to a firewall
+func sameRules(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// diffRules returns the rules that are only in desired, and only in current
+func diffRules(current, desired []string) (added []string, removed []string) {
+	have := make(map[string]int)
+	for _, rule := range current {
+		have[rule]++
+	}
+	for _, rule := range desired {
+		if have[rule] > 0 {
+			have[rule]--
+		} else {
+			added = append(added, rule)
+		}
+	}
+	for _, rule := range current {
+		if have[rule] > 0 {
+			have[rule]--
+			removed = append(removed, rule)
+		}
+	}
+	return added, removed
+}
+
+// splitLines returns the non-empty, trimmed lines of command output
+func splitLines(out string) []string {
+	lines := []string{}
+	for _, line := range strings.Split(out, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+// the states a service can be in, whichever init system manages it
+const (
+	ServiceRunning  = "running"
+	ServiceStopped  = "stopped"
+	ServiceStarting = "starting"
+	ServiceStopping = "stopping"
+)
+
+const (
+	// how long Start, Stop and Restart wait for a service to get where it was asked to go
+	ServiceStateTimeout = time.Second * 30
+	// how often the state is polled while waiting
+	servicePollInterval = time.Millisecond * 250
+)
+
+// ServiceManager starts and stops services through the init system. Start, Stop and Restart
+// return once the service has reached the requested state, or with an error if it doesn't.
+type ServiceManager interface {
+	Name() string
+	Start(name string) error
+	Stop(name string) error
+	Restart(name string) error
+	// Status returns one of the Service* states
+	Status(name string) (string, error)
+}
+
+// NewServiceManager returns the named service manager, or for "auto" (or nothing), the one that
+// booted the sphere
+func NewServiceManager(name string) (ServiceManager, error) {
+	switch name {
+	case "upstart":
+		return &upstartManager{}, nil
+	case "systemd":
+		return &systemdManager{}, nil
+	case "", "auto":
+		// as sd_booted(3) does it
+		if _, err := os.Stat("/run/systemd/system"); err == nil {
+			return &systemdManager{}, nil
+		}
+		return &upstartManager{}, nil
+	default:
+		return nil, fmt.Errorf("unknown service manager: %s", name)
+	}
+}
+
+// waitForServiceState polls the status of a service until it is in the wanted state
+func waitForServiceState(m ServiceManager, name string, want string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		state, err := m.Status(name)
+		if err != nil {
+			return err
+		}
+		if state == want {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("%s is %s after %s, expected %s", name, state, timeout, want)
+		}
+		time.Sleep(servicePollInterval)
+	}
+}
+
+// Service is a single service of a ServiceManager
+type Service struct {
+	Name    string
+	Manager ServiceManager
+}
+
+func (s *Service) Start() error {
+	logger.Debugf("Starting %s service: %s", s.Manager.Name(), s.Name)
+	return s.Manager.Start(s.Name)
+}
+
+func (s *Service) Stop() error {
+	logger.Debugf("Stopping %s service: %s", s.Manager.Name(), s.Name)
+	return s.Manager.Stop(s.Name)
+}
+
+func (s *Service) Restart() error {
+	logger.Debugf("Restarting %s service: %s", s.Manager.Name(), s.Name)
+	return s.Manager.Restart(s.Name)
+}
+
+func (s *Service) Status() (string, error) {
+	return s.Manager.Status(s.Name)
+}
+
+func (s *Service) Running() (bool, error) {
+	status, err := s.Status()
+	if err != nil {
+		return false, err
+	}
+	return status == ServiceRunning, nil
+}
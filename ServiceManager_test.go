@@ -0,0 +1,208 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// FakeServiceManager keeps service states in memory.
+// Every call is recorded in Calls, e.g. "start hostapd-ap0".
+type FakeServiceManager struct {
+	sync.Mutex
+	States map[string]string // by service name, missing services are unknown
+	Fail   map[string]error  // calls that fail, by the same name as in Calls
+	Calls  []string
+}
+
+func NewFakeServiceManager(services ...string) *FakeServiceManager {
+	m := &FakeServiceManager{
+		States: make(map[string]string),
+		Fail:   make(map[string]error),
+	}
+	for _, name := range services {
+		m.States[name] = ServiceStopped
+	}
+	return m
+}
+
+func (m *FakeServiceManager) Name() string {
+	return "fake"
+}
+
+func (m *FakeServiceManager) control(command string, name string, want string) error {
+	m.Lock()
+	defer m.Unlock()
+
+	call := command + " " + name
+	m.Calls = append(m.Calls, call)
+	if err, ok := m.Fail[call]; ok {
+		return err
+	}
+	if _, ok := m.States[name]; !ok {
+		return fmt.Errorf("unknown service: %s", name)
+	}
+	m.States[name] = want
+	return nil
+}
+
+func (m *FakeServiceManager) Start(name string) error {
+	return m.control("start", name, ServiceRunning)
+}
+
+func (m *FakeServiceManager) Stop(name string) error {
+	return m.control("stop", name, ServiceStopped)
+}
+
+func (m *FakeServiceManager) Restart(name string) error {
+	return m.control("restart", name, ServiceRunning)
+}
+
+func (m *FakeServiceManager) Status(name string) (string, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	if err, ok := m.Fail["status "+name]; ok {
+		return "", err
+	}
+	state, ok := m.States[name]
+	if !ok {
+		return "", fmt.Errorf("unknown service: %s", name)
+	}
+	return state, nil
+}
+
+func TestParseUpstartStatus(t *testing.T) {
+	for _, test := range []struct {
+		out   string
+		state string
+	}{
+		{"hostapd-ap0 start/running, process 1234\n", ServiceRunning},
+		{"hostapd-ap0 stop/waiting\n", ServiceStopped},
+		{"hostapd-ap0 start/pre-start, process 1234\n", ServiceStarting},
+		{"hostapd-ap0 start/post-stop\n", ServiceStarting},
+		{"hostapd-ap0 stop/pre-stop, process 1234\n", ServiceStopping},
+		{"hostapd-ap0 stop/killed, process 1234\n", ServiceStopping},
+	} {
+		state, err := parseUpstartStatus("hostapd-ap0", test.out)
+		if err != nil {
+			t.Errorf("%q: unexpected error: %v", test.out, err)
+		} else if state != test.state {
+			t.Errorf("%q: expected %s, got %s", test.out, test.state, state)
+		}
+	}
+
+	for _, out := range []string{
+		"",
+		"dnsmasq start/running, process 1234\n",
+		"hostapd-ap0 running\n",
+	} {
+		if state, err := parseUpstartStatus("hostapd-ap0", out); err == nil {
+			t.Errorf("%q: expected an error, got %s", out, state)
+		}
+	}
+}
+
+func TestWaitForServiceState(t *testing.T) {
+	m := NewFakeServiceManager("hostapd-ap0")
+	m.States["hostapd-ap0"] = ServiceStarting
+
+	go func() {
+		time.Sleep(servicePollInterval)
+		m.Lock()
+		m.States["hostapd-ap0"] = ServiceRunning
+		m.Unlock()
+	}()
+
+	if err := waitForServiceState(m, "hostapd-ap0", ServiceRunning, time.Second*5); err != nil {
+		t.Errorf("expected hostapd-ap0 to start, got %v", err)
+	}
+}
+
+func TestWaitForServiceStateTimeout(t *testing.T) {
+	m := NewFakeServiceManager("hostapd-ap0")
+	m.States["hostapd-ap0"] = ServiceStarting
+
+	timeout := servicePollInterval * 2
+	started := time.Now()
+	err := waitForServiceState(m, "hostapd-ap0", ServiceRunning, timeout)
+	if err == nil {
+		t.Fatalf("expected a timeout")
+	}
+	if !strings.Contains(err.Error(), "hostapd-ap0 is starting") {
+		t.Errorf("expected the error to say where the service got to, got %v", err)
+	}
+	if elapsed := time.Since(started); elapsed < timeout {
+		t.Errorf("gave up after %s, before the %s timeout", elapsed, timeout)
+	}
+
+	m.Fail["status hostapd-ap0"] = errors.New("status failed")
+	if err := waitForServiceState(m, "hostapd-ap0", ServiceRunning, timeout); err == nil || err.Error() != "status failed" {
+		t.Errorf("expected the status error, got %v", err)
+	}
+}
+
+func newFakeAccessPointManager(services ...string) (*AccessPointManager, *FakeServiceManager) {
+	config := AssistantConfig{}
+	// a configured key, so that the test doesn't generate one in /data
+	config.Wireless_Host.Key = "not-a-real-key"
+	fake := NewFakeServiceManager(services...)
+	return NewAccessPointManagerWithServices(config, fake), fake
+}
+
+func TestStartHostAP(t *testing.T) {
+	a, fake := newFakeAccessPointManager("hostapd-ap0", "dnsmasq")
+
+	if err := a.StartHostAP(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if running, _ := a.HostapdJob.Running(); !running {
+		t.Errorf("expected hostapd-ap0 to be running")
+	}
+	if calls := strings.Join(fake.Calls, ", "); calls != "restart hostapd-ap0, restart dnsmasq" {
+		t.Errorf("unexpected calls: %s", calls)
+	}
+
+	if err := a.StopHostAP(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if running, _ := a.HostapdJob.Running(); running {
+		t.Errorf("expected hostapd-ap0 to be stopped")
+	}
+}
+
+func TestStartHostAPErrors(t *testing.T) {
+	a, fake := newFakeAccessPointManager("hostapd-ap0", "dnsmasq")
+	fake.Fail["restart hostapd-ap0"] = errors.New("no radio")
+
+	if err := a.StartHostAP(); err == nil || !strings.Contains(err.Error(), "no radio") {
+		t.Errorf("expected the hostapd error, got %v", err)
+	}
+	if calls := strings.Join(fake.Calls, ", "); calls != "restart hostapd-ap0" {
+		t.Errorf("dnsmasq shouldn't be restarted without hostapd, got calls: %s", calls)
+	}
+
+	delete(fake.Fail, "restart hostapd-ap0")
+	fake.Fail["restart dnsmasq"] = errors.New("bad configuration")
+	if err := a.StartHostAP(); err == nil || !strings.Contains(err.Error(), "bad configuration") {
+		t.Errorf("expected the dnsmasq error, got %v", err)
+	}
+
+	a, _ = newFakeAccessPointManager("dnsmasq")
+	if err := a.StartHostAP(); err == nil || !strings.Contains(err.Error(), "unknown service: hostapd-ap0") {
+		t.Errorf("expected an error for the missing job, got %v", err)
+	}
+}
+
+func TestStopHostAPErrors(t *testing.T) {
+	a, fake := newFakeAccessPointManager("hostapd-ap0", "dnsmasq")
+	fake.States["hostapd-ap0"] = ServiceRunning
+	fake.Fail["stop hostapd-ap0"] = errors.New("still running")
+
+	if err := a.StopHostAP(); err == nil || !strings.Contains(err.Error(), "still running") {
+		t.Errorf("expected the stop error, got %v", err)
+	}
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/ninjasphere/go-wireless/wpactl"
+)
+
+// WifiEvent is a notification from the backend, named after the wpa_supplicant event (CTRL-EVENT-CONNECTED etc.)
+type WifiEvent struct {
+	Name      string
+	Arguments map[string]string
+}
+
+// WifiBackend is everything WifiManager needs from the wireless stack. On the sphere this is
+// wpa_supplicant, off-device it can be a WifiSimulator.
+type WifiBackend interface {
+	// TriggerScan asks for a scan, CTRL-EVENT-SCAN-RESULTS is emitted when it completes
+	TriggerScan() error
+	// ScanResults returns the BSS table from the last scan
+	ScanResults() ([]ScanResult, error)
+	// Status returns the key=value pairs describing the current connection, as reported by STATUS
+	Status() (map[string]string, error)
+	// SignalPoll returns the key=value pairs describing the current link, as reported by SIGNAL_POLL
+	SignalPoll() (map[string]string, error)
+
+	ListNetworks() ([]int, error)
+	AddNetwork() (int, error)
+	RemoveNetwork(id int) error
+	SetNetworkSettingRaw(id int, name string, value string) error
+	SetNetworkSettingString(id int, name string, value string) error
+	GetNetworkSetting(id int, name string) (string, error)
+	SelectNetwork(id int) error
+	EnableNetwork(id int) error
+	DisableNetwork(id int) error
+	ReloadConfiguration() error
+	SaveConfiguration() error
+
+	// SetCountry sets the regulatory domain, SaveConfiguration keeps it
+	SetCountry(country string) error
+
+	// StartWPS starts push button configuration, WPS-SUCCESS or WPS-FAIL etc. is emitted when it completes
+	StartWPS() error
+	CancelWPS() error
+
+	Events() <-chan WifiEvent
+	// Address returns the ipv4 address of the interface, or an error if it doesn't have one
+	Address() (string, error)
+
+	Cleanup()
+}
+
+// wpaBackend talks to wpa_supplicant through its control socket
+type wpaBackend struct {
+	iface  string
+	ctl    *wpactl.WPAController
+	events chan WifiEvent
+}
+
+func NewWPABackend(iface string) (WifiBackend, error) {
+	ctl, err := wpactl.NewController(iface)
+	if err != nil {
+		return nil, err
+	}
+
+	b := &wpaBackend{
+		iface:  iface,
+		ctl:    ctl,
+		events: make(chan WifiEvent, 32),
+	}
+
+	go func() {
+		for event := range ctl.EventChannel {
+			b.events <- WifiEvent{event.Name, event.Arguments}
+		}
+	}()
+
+	return b, nil
+}
+
+// command sends a raw command to wpa_supplicant, treating anything other than OK as an error
+func (b *wpaBackend) command(format string, args ...interface{}) error {
+	cmd := fmt.Sprintf(format, args...)
+	resp, err := b.ctl.SendCommand(cmd)
+	if err != nil {
+		return err
+	}
+	if strings.TrimSpace(resp) != "OK" {
+		return fmt.Errorf("%s failed: %s", cmd, strings.TrimSpace(resp))
+	}
+	return nil
+}
+
+func (b *wpaBackend) TriggerScan() error {
+	err := b.command("SCAN")
+	if err != nil && strings.Contains(err.Error(), "FAIL-BUSY") {
+		// already scanning, the results will arrive all the same
+		return nil
+	}
+	return err
+}
+
+func (b *wpaBackend) ScanResults() ([]ScanResult, error) {
+	raw, err := b.ctl.SendCommand("SCAN_RESULTS")
+	if err != nil {
+		return nil, err
+	}
+	return parseScanResults(raw), nil
+}
+
+func (b *wpaBackend) Status() (map[string]string, error) {
+	raw, err := b.ctl.SendCommand("STATUS")
+	if err != nil {
+		return nil, err
+	}
+	return parseKeyValues(raw), nil
+}
+
+func (b *wpaBackend) SignalPoll() (map[string]string, error) {
+	raw, err := b.ctl.SendCommand("SIGNAL_POLL")
+	if err != nil {
+		return nil, err
+	}
+	if strings.HasPrefix(strings.TrimSpace(raw), "FAIL") {
+		return nil, fmt.Errorf("SIGNAL_POLL failed: %s", strings.TrimSpace(raw))
+	}
+	return parseKeyValues(raw), nil
+}
+
+func (b *wpaBackend) ListNetworks() ([]int, error) {
+	networks, err := b.ctl.ListNetworks()
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]int, len(networks))
+	for i, network := range networks {
+		ids[i] = network.Id
+	}
+	return ids, nil
+}
+
+func (b *wpaBackend) AddNetwork() (int, error) {
+	return b.ctl.AddNetwork()
+}
+
+func (b *wpaBackend) RemoveNetwork(id int) error {
+	return b.command("REMOVE_NETWORK %d", id)
+}
+
+func (b *wpaBackend) SetNetworkSettingRaw(id int, name string, value string) error {
+	return b.ctl.SetNetworkSettingRaw(id, name, value)
+}
+
+func (b *wpaBackend) SetNetworkSettingString(id int, name string, value string) error {
+	return b.ctl.SetNetworkSettingString(id, name, value)
+}
+
+func (b *wpaBackend) GetNetworkSetting(id int, name string) (string, error) {
+	return b.ctl.GetNetworkSetting(id, name)
+}
+
+func (b *wpaBackend) SelectNetwork(id int) error {
+	return b.ctl.SelectNetwork(id)
+}
+
+func (b *wpaBackend) EnableNetwork(id int) error {
+	return b.ctl.EnableNetwork(id)
+}
+
+func (b *wpaBackend) DisableNetwork(id int) error {
+	return b.ctl.DisableNetwork(id)
+}
+
+func (b *wpaBackend) ReloadConfiguration() error {
+	return b.ctl.ReloadConfiguration()
+}
+
+func (b *wpaBackend) SaveConfiguration() error {
+	return b.ctl.SaveConfiguration()
+}
+
+func (b *wpaBackend) SetCountry(country string) error {
+	return b.command("SET country %s", country)
+}
+
+func (b *wpaBackend) StartWPS() error {
+	return b.command("WPS_PBC")
+}
+
+func (b *wpaBackend) CancelWPS() error {
+	return b.command("WPS_CANCEL")
+}
+
+func (b *wpaBackend) Events() <-chan WifiEvent {
+	return b.events
+}
+
+func (b *wpaBackend) Address() (string, error) {
+	return GetInterfaceAddress(b.iface)
+}
+
+func (b *wpaBackend) Cleanup() {
+	b.ctl.Cleanup()
+}
+
+func parseKeyValues(raw string) map[string]string {
+	values := make(map[string]string)
+	for _, line := range strings.Split(raw, "\n") {
+		parts := strings.SplitN(strings.TrimSpace(line), "=", 2)
+		if len(parts) == 2 {
+			values[parts[0]] = parts[1]
+		}
+	}
+	return values
+}
+
+// statusInt reads an integer field from a STATUS or SIGNAL_POLL response
+func statusInt(values map[string]string, key string) (int, bool) {
+	i, err := strconv.Atoi(values[key])
+	return i, err == nil
+}
@@ -1,119 +1,203 @@
 package main
 
-import "github.com/ninjasphere/go-wireless/wpactl"
+import (
+	"encoding/hex"
+	"fmt"
+	"sync"
+)
 
 type WifiManager struct {
-	Controller  *wpactl.WPAController
-	stateChange []chan string
+	Backend     WifiBackend
+	states      *stateBroadcaster
 	ackPending  bool   // true if we need to wait for acknowledgment from app
 	onAck       func() // optional function to execute once acnknowledgment of credentials received
+	scanLock    sync.Mutex
+	lastScan    *WifiScan
+	scanDone    chan bool // closed when the scan in progress completes
+	probe       ReachabilityProbe
+	portalProbe PortalProbe
+	connLock    sync.Mutex
+	associated  bool          // wpa_supplicant has completed association
+	ip          string        // the last address seen on the interface, if associated
+	online      bool          // the reachability probe succeeded since the address was assigned
+	portal      *PortalResult // the captive portal check for the current association, if it has been done
+	wpsLock     sync.Mutex
+	wps         chan string // receives the WPS-* events while push button configuration is in progress
+	link        linkMonitor
 }
 
 const (
 	WifiStateDisconnected = "disconnected"
 	WifiStateConnected    = "connected"
 	WifiStateInvalidKey   = "invalid_key"
+	WifiStateAuthFailed   = "auth_failed"
+	WifiStateRejected     = "rejected"
+	WifiStateNotFound     = "not_found"
+	WifiStateHasIP        = "has_ip" // associated and dhcp has assigned an address
+	WifiStateOnline       = "online" // has an address and the reachability probe succeeds
 )
 
-func NewWifiManager(iface string) (*WifiManager, error) {
-	ctl, err := wpactl.NewController(iface)
+func NewWifiManager(iface string, config AssistantConfig) (*WifiManager, error) {
+	backend, err := NewWPABackend(iface)
 	if err != nil {
 		return nil, err
 	}
 
+	return NewWifiManagerWithBackend(backend, config), nil
+}
+
+// NewWifiManagerWithBackend creates a manager driving the given backend, e.g. a WifiSimulator
+func NewWifiManagerWithBackend(backend WifiBackend, config AssistantConfig) *WifiManager {
+	return NewWifiManagerWithProbes(backend, NewReachabilityProbe(config), NewPortalProbe(config))
+}
+
+// NewWifiManagerWithProbes creates a manager driving the given backend, deciding whether it is
+// online and behind a captive portal with the given probes rather than the configured ones
+func NewWifiManagerWithProbes(backend WifiBackend, probe ReachabilityProbe, portalProbe PortalProbe) *WifiManager {
 	manager := &WifiManager{}
-	manager.stateChange = make([]chan string, 0)
-	manager.Controller = ctl
+	// until the backend tells us otherwise, assume we're disconnected
+	manager.states = newStateBroadcaster(WifiStateDisconnected)
+	manager.Backend = backend
+	manager.probe = probe
+	manager.portalProbe = portalProbe
 
 	go manager.eventLoop()
+	go manager.addressLoop()
+	go manager.scanLoop()
+	go manager.linkQualityLoop()
 
-	return manager, nil
+	return manager
 }
 
-func (m *WifiManager) WatchState() chan string {
-	ch := make(chan string, 128)
-
-	m.stateChange = append(m.stateChange, ch)
-
-	return ch
+// SubscribeState returns a subscription to the wifi state changes. Unless opts.NoReplay is set,
+// the current state is delivered straight away.
+func (m *WifiManager) SubscribeState(opts SubscribeOptions) *StateSubscription {
+	return m.states.Subscribe(opts)
 }
 
-func (m *WifiManager) UnwatchState(target chan string) {
-	for i, c := range m.stateChange {
-		if c == target {
-			m.stateChange[i] = nil
-		}
-	}
+// State returns the last state emitted
+func (m *WifiManager) State() string {
+	return m.states.Last()
 }
 
 func (m *WifiManager) emitState(state string) {
-	for _, ch := range m.stateChange {
-		if ch != nil {
-			ch <- state
-		}
-	}
+	m.states.Emit(state)
 }
 
 func (m *WifiManager) eventLoop() {
 	for {
-		event := <-m.Controller.EventChannel
+		event := <-m.Backend.Events()
 		logger.Infof("eventLoop: %v", event)
+		m.link.countEvent(event.Name)
 		switch event.Name {
 		case "CTRL-EVENT-DISCONNECTED":
+			m.setAssociated(false)
 			m.emitState(WifiStateDisconnected)
 		case "CTRL-EVENT-CONNECTED":
+			m.setAssociated(true)
 			m.emitState(WifiStateConnected)
 		case "CTRL-EVENT-SSID-TEMP-DISABLED":
-			m.emitState(WifiStateInvalidKey)
+			switch event.Arguments["reason"] {
+			case "WRONG_KEY", "":
+				m.emitState(WifiStateInvalidKey)
+			default:
+				// CONN_FAILED, AUTH_FAILED etc.
+				m.emitState(WifiStateAuthFailed)
+			}
+		case "CTRL-EVENT-ASSOC-REJECT", "CTRL-EVENT-AUTH-REJECT":
+			m.emitState(WifiStateRejected)
+		case "CTRL-EVENT-NETWORK-NOT-FOUND":
+			m.emitState(WifiStateNotFound)
+		case "CTRL-EVENT-SCAN-RESULTS":
+			m.updateScanCache(true)
+		case "WPS-SUCCESS", "WPS-FAIL", "WPS-TIMEOUT", "WPS-OVERLAP-DETECTED":
+			m.wpsEvent(event.Name)
 		}
 	}
 }
 
+// Address returns the ipv4 address of the wireless interface
+func (m *WifiManager) Address() (string, error) {
+	return m.Backend.Address()
+}
+
 func (m *WifiManager) Cleanup() {
-	m.Controller.Cleanup()
+	m.Backend.Cleanup()
 }
 
-func (m *WifiManager) SetCredentials(wifi_creds *WifiCredentials) bool {
+func (m *WifiManager) SetCredentials(wifi_creds *WifiCredentials) *ConnectResult {
 
-	logger.Infof("SetCredentials: Setting credentials. ssid: %s - password length: %d", wifi_creds.SSID, len(wifi_creds.Key))
+	if wifi_creds.IsEnterprise() {
+		logger.Infof("SetCredentials: Setting enterprise credentials. ssid: %s - eap: %s - identity: %s", wifi_creds.SSID, wifi_creds.EAP, wifi_creds.Identity)
+	} else {
+		logger.Infof("SetCredentials: Setting credentials. ssid: %s - password length: %d", wifi_creds.SSID, len(wifi_creds.Key))
+	}
 
 	m.ackPending = true
-	WriteToFile("/etc/network/interfaces.d/wlan0", WLANInterfaceTemplate)
 
-	states := m.WatchState()
+	// keep the user's ip configuration, unless they've sent a new one along with the credentials
+	if wifi_creds.IPConfig != nil {
+		if err := SaveIPConfig(wifi_creds.IPConfig); err != nil {
+			logger.Errorf("SetCredentials: Invalid ip configuration: %v", err)
+			m.ackPending = false
+			return connectFailed(wifi_creds.SSID, ConnectReasonInvalidConfig, err.Error())
+		}
+	} else if err := WriteWLANInterfaces(LoadIPConfig()); err != nil {
+		logger.Errorf("SetCredentials: Failed to write %s: %v", WLANInterfacesFile, err)
+	}
 
-	m.AddStandardNetwork(wifi_creds.SSID, wifi_creds.Key)
-	m.Controller.ReloadConfiguration()
+	// we only care about states caused by the new network, not the one we're leaving
+	states := m.SubscribeState(SubscribeOptions{Buffer: 32, Policy: DropOldest, NoReplay: true})
+	defer states.Unsubscribe()
 
-	success := true
-	for {
-		state := <-states
-		logger.Infof("SetCredentials: Network state: %s", state)
-		if state == WifiStateConnected {
-			success = true
-			break
-		} else if state == WifiStateInvalidKey {
-			m.ackPending = false
-			success = false
-			break
+	security := m.resolveSecurity(wifi_creds)
+	logger.Infof("SetCredentials: Using security type %s", security)
+
+	// remember what was working, so that we can go back to it if the new network doesn't work out
+	snapshot := m.beginCredentialChange()
+
+	var id int
+	var err error
+	if wifi_creds.IsEnterprise() || security == WifiSecurityEnterprise {
+		id, err = m.AddEnterpriseNetwork(wifi_creds)
+	} else {
+		id, err = m.AddStandardNetwork(wifi_creds.SSID, wifi_creds.Key, security)
+	}
+	if err != nil {
+		logger.Errorf("SetCredentials: Failed to add network: %v", err)
+		m.ackPending = false
+		result := connectFailed(wifi_creds.SSID, ConnectReasonInvalidConfig, err.Error())
+		if id >= 0 {
+			// otherwise the credentials were refused before anything changed
+			m.rollbackCredentialChange(snapshot, id, result)
 		}
+		return result
 	}
+	m.Backend.ReloadConfiguration()
 
-	m.UnwatchState(states)
+	result := m.waitForConnection(wifi_creds.SSID, states.C)
+	result.Insecure = wifi_creds.IsEnterprise() && !wifi_creds.ValidatesServer()
+	if !result.Success {
+		m.ackPending = false
+		states.Unsubscribe()
+		if result.Reason != ConnectReasonCaptivePortal {
+			m.rollbackCredentialChange(snapshot, id, result)
+		}
+	}
 
-	logger.Debugf("SetCredentials: Returning Success: %t", success)
+	logger.Debugf("SetCredentials: Returning result: %v", result)
 
-	return success
+	return result
 }
 
 func (m *WifiManager) WifiConfigured() (bool, error) {
-	networks, err := m.Controller.ListNetworks()
+	networks, err := m.Backend.ListNetworks()
 	if err != nil {
 		return false, nil
 	}
 	enabledNetworks := 0
-	for _, network := range networks {
-		result, _ := m.Controller.GetNetworkSetting(network.Id, "disabled")
+	for _, id := range networks {
+		result, _ := m.Backend.GetNetworkSetting(id, "disabled")
 		if result == "1" {
 			continue
 		}
@@ -122,35 +206,134 @@ func (m *WifiManager) WifiConfigured() (bool, error) {
 	return (enabledNetworks > 0), nil
 }
 
-func (m *WifiManager) DisableAllNetworks() error {
-	networks, err := m.Controller.ListNetworks()
+// resolveSecurity fills in the security type from the scan results when the app didn't provide one
+func (m *WifiManager) resolveSecurity(wifi_creds *WifiCredentials) string {
+	if wifi_creds.Security != "" {
+		return wifi_creds.Security
+	}
+	if security, ok := m.LookupSecurity(wifi_creds.SSID); ok {
+		return security
+	}
+	// hidden or out of range network, guess from the key
+	if wifi_creds.Key == "" {
+		return WifiSecurityOpen
+	}
+	return WifiSecurityWPAPSK
+}
+
+// AddStandardNetwork adds and selects a network using a pre-shared key (or none), returning the id of the new network
+func (m *WifiManager) AddStandardNetwork(ssid string, key string, security string) (int, error) {
+	switch security {
+	case WifiSecurityOpen, WifiSecurityWEP, WifiSecurityWPAPSK, WifiSecuritySAE, WifiSecurityTransition:
+	default:
+		return -1, fmt.Errorf("unsupported security type: %s", security)
+	}
+
+	if security == WifiSecurityWPAPSK || security == WifiSecurityTransition {
+		if !isHexKey(key, 64) && (len(key) < 8 || len(key) > 63) {
+			return -1, fmt.Errorf("WPA passphrase must be between 8 and 63 characters")
+		}
+	}
+
+	i, err := m.Backend.AddNetwork()
 	if err != nil {
-		return err
+		return -1, err
+	}
+	// as for enterprise networks, a setting that wpa_supplicant rejects (SAE on an old build, say)
+	// is reported rather than left to show up as a connection that never happens
+	var setErr error
+	set := func(name string, value string) {
+		if setErr == nil {
+			if err := m.Backend.SetNetworkSettingString(i, name, value); err != nil {
+				setErr = fmt.Errorf("invalid %s: %v", name, err)
+			}
+		}
+	}
+	setRaw := func(name string, value string) {
+		if setErr == nil {
+			if err := m.Backend.SetNetworkSettingRaw(i, name, value); err != nil {
+				setErr = fmt.Errorf("invalid %s: %v", name, err)
+			}
+		}
+	}
+	setPSK := func() {
+		if setErr == nil {
+			setErr = m.setPSK(i, key)
+		}
 	}
 
-	for _, network := range networks {
-		m.Controller.DisableNetwork(network.Id)
+	set("ssid", ssid)
+	setRaw("scan_ssid", "1")
+
+	switch security {
+	case WifiSecurityOpen:
+		setRaw("key_mgmt", "NONE")
+	case WifiSecurityWEP:
+		setRaw("key_mgmt", "NONE")
+		setRaw("auth_alg", "OPEN SHARED")
+		// 10 or 26 hex digits are raw keys, 5 or 13 characters are ascii keys
+		if isHexKey(key, 10) || isHexKey(key, 26) {
+			setRaw("wep_key0", key)
+		} else {
+			set("wep_key0", key)
+		}
+		setRaw("wep_tx_keyidx", "0")
+	case WifiSecurityWPAPSK:
+		setRaw("key_mgmt", "WPA-PSK")
+		setPSK()
+	case WifiSecuritySAE:
+		// WPA3 requires management frame protection
+		setRaw("key_mgmt", "SAE")
+		set("sae_password", key)
+		setRaw("ieee80211w", "2")
+	case WifiSecurityTransition:
+		// prefer SAE, but fall back to WPA2 for access points that only do PSK, with optional PMF
+		setRaw("key_mgmt", "WPA-PSK SAE")
+		setPSK()
+		set("sae_password", key)
+		setRaw("ieee80211w", "1")
 	}
 
-	return nil
+	if setErr == nil {
+		if err := m.Backend.SelectNetwork(i); err != nil {
+			setErr = fmt.Errorf("failed to select the network: %v", err)
+		}
+	}
+	if setErr == nil {
+		if err := m.Backend.SaveConfiguration(); err != nil {
+			setErr = fmt.Errorf("failed to save the configuration: %v", err)
+		}
+	}
+	if setErr != nil {
+		// the id is returned so that the half configured network is removed
+		return i, setErr
+	}
+
+	return i, nil
 }
 
-func (m *WifiManager) AddStandardNetwork(ssid string, key string) error {
-	i, err := m.Controller.AddNetwork()
+func (m *WifiManager) setPSK(id int, key string) error {
+	var err error
+	if isHexKey(key, 64) {
+		// a pre-computed 256 bit psk
+		err = m.Backend.SetNetworkSettingRaw(id, "psk", key)
+	} else {
+		err = m.Backend.SetNetworkSettingString(id, "psk", key)
+	}
 	if err != nil {
-		return err
+		return fmt.Errorf("invalid psk: %v", err)
 	}
-	// FIXME: handle errors for all of these!
-	m.Controller.SetNetworkSettingString(i, "ssid", ssid)
-	m.Controller.SetNetworkSettingString(i, "psk", key)
-	m.Controller.SetNetworkSettingRaw(i, "scan_ssid", "1")
-	m.Controller.SetNetworkSettingRaw(i, "key_mgmt", "WPA-PSK")
-	m.Controller.SelectNetwork(i)
-	m.Controller.SaveConfiguration()
-
 	return nil
 }
 
+func isHexKey(key string, length int) bool {
+	if len(key) != length {
+		return false
+	}
+	_, err := hex.DecodeString(key)
+	return err == nil
+}
+
 func (m *WifiManager) ConnectionAcknowledged() {
 	if m.ackPending {
 		m.ackPending = false
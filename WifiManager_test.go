@@ -0,0 +1,226 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newSimulatedWifiManager drives a WifiSimulator that can see the given access points, with the ip
+// configuration kept in a temporary directory, a reachability probe that always succeeds and no
+// portal probe
+func newSimulatedWifiManager(t *testing.T, accessPoints ...SimulatedAccessPoint) (*WifiManager, *WifiSimulator) {
+	return newSimulatedWifiManagerWithPortal(t, PortalProbe{}, accessPoints...)
+}
+
+func newSimulatedWifiManagerWithPortal(t *testing.T, portalProbe PortalProbe, accessPoints ...SimulatedAccessPoint) (*WifiManager, *WifiSimulator) {
+	dir := t.TempDir()
+	interfacesFile, ipConfigFile := WLANInterfacesFile, WLANIPConfigFile
+	WLANInterfacesFile = filepath.Join(dir, "wlan0")
+	WLANIPConfigFile = filepath.Join(dir, "wlan0-ip.json")
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	t.Cleanup(func() {
+		listener.Close()
+		WLANInterfacesFile, WLANIPConfigFile = interfacesFile, ipConfigFile
+	})
+
+	probe := ReachabilityProbe{Address: listener.Addr().String(), Interval: time.Second, Timeout: time.Second}
+	sim := NewWifiSimulator(accessPoints...)
+	return NewWifiManagerWithProbes(sim, probe, portalProbe), sim
+}
+
+func simulatedAccessPoint(ssid string, script []SimulatedStep) SimulatedAccessPoint {
+	return SimulatedAccessPoint{
+		SSID:      ssid,
+		BSSID:     "02:00:00:00:00:01",
+		Frequency: 2437,
+		Signal:    -50,
+		Flags:     "[WPA2-PSK-CCMP][ESS]",
+		Script:    script,
+	}
+}
+
+func TestSetCredentialsConnects(t *testing.T) {
+	m, sim := newSimulatedWifiManager(t, simulatedAccessPoint("home", ScriptConnect("192.168.1.20", time.Millisecond*200)))
+
+	result := m.SetCredentials(&WifiCredentials{SSID: "home", Key: "correct horse", Security: WifiSecurityWPAPSK})
+	if !result.Success {
+		t.Fatalf("expected to connect, got %+v", result)
+	}
+	if result.IP != "192.168.1.20" {
+		t.Errorf("expected the simulated address, got %q", result.IP)
+	}
+	if m.State() != WifiStateOnline {
+		t.Errorf("expected to be online, got %s", m.State())
+	}
+
+	networks, _ := sim.ListNetworks()
+	if len(networks) != 1 {
+		t.Fatalf("expected the new network to be kept, got %v", networks)
+	}
+	if psk, _ := sim.GetNetworkSetting(networks[0], "psk"); psk != `"correct horse"` {
+		t.Errorf("unexpected psk: %s", psk)
+	}
+
+	data, err := ioutil.ReadFile(WLANInterfacesFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), "iface wlan0 inet dhcp") {
+		t.Errorf("expected the default dhcp configuration, got %q", data)
+	}
+}
+
+func TestSetCredentialsWrongKey(t *testing.T) {
+	m, sim := newSimulatedWifiManager(t, simulatedAccessPoint("home", ScriptWrongKey()))
+
+	result := m.SetCredentials(&WifiCredentials{SSID: "home", Key: "not the key", Security: WifiSecurityWPAPSK})
+	if result.Success || result.Reason != ConnectReasonWrongKey {
+		t.Fatalf("expected %s, got %+v", ConnectReasonWrongKey, result)
+	}
+	if result.Restored {
+		t.Errorf("there was nothing to restore, got %+v", result)
+	}
+
+	if networks, _ := sim.ListNetworks(); len(networks) != 0 {
+		t.Errorf("expected the failed network to be removed, got %v", networks)
+	}
+}
+
+func TestSetCredentialsNotFound(t *testing.T) {
+	m, sim := newSimulatedWifiManager(t)
+
+	result := m.SetCredentials(&WifiCredentials{SSID: "elsewhere", Key: "correct horse", Security: WifiSecurityWPAPSK})
+	if result.Success || result.Reason != ConnectReasonNotFound {
+		t.Fatalf("expected %s, got %+v", ConnectReasonNotFound, result)
+	}
+
+	if networks, _ := sim.ListNetworks(); len(networks) != 0 {
+		t.Errorf("expected the failed network to be removed, got %v", networks)
+	}
+}
+
+func TestSetCredentialsRefused(t *testing.T) {
+	m, sim := newSimulatedWifiManager(t, simulatedAccessPoint("home", ScriptConnect("192.168.1.20", time.Millisecond*200)))
+
+	start := time.Now()
+	result := m.SetCredentials(&WifiCredentials{SSID: "home", Key: "short", Security: WifiSecurityWPAPSK})
+	if result.Success || result.Reason != ConnectReasonInvalidConfig {
+		t.Fatalf("expected %s, got %+v", ConnectReasonInvalidConfig, result)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expected to fail straight away, took %s", elapsed)
+	}
+
+	if networks, _ := sim.ListNetworks(); len(networks) != 0 {
+		t.Errorf("expected no network to be added, got %v", networks)
+	}
+}
+
+func TestSetCredentialsRollsBack(t *testing.T) {
+	m, sim := newSimulatedWifiManager(t,
+		simulatedAccessPoint("home", ScriptConnect("192.168.1.20", time.Millisecond*200)),
+		simulatedAccessPoint("neighbour", ScriptWrongKey()))
+
+	if result := m.SetCredentials(&WifiCredentials{SSID: "home", Key: "correct horse", Security: WifiSecurityWPAPSK}); !result.Success {
+		t.Fatalf("expected to connect to home, got %+v", result)
+	}
+	home, _ := sim.ListNetworks()
+
+	result := m.SetCredentials(&WifiCredentials{SSID: "neighbour", Key: "not the key", Security: WifiSecurityWPAPSK})
+	if result.Success || result.Reason != ConnectReasonWrongKey {
+		t.Fatalf("expected %s, got %+v", ConnectReasonWrongKey, result)
+	}
+	if !result.Restored || result.RestoredSSID != "home" {
+		t.Errorf("expected to be back on home, got %+v", result)
+	}
+
+	networks, _ := sim.ListNetworks()
+	if len(networks) != 1 || networks[0] != home[0] {
+		t.Fatalf("expected only home to be left, got %v", networks)
+	}
+	if disabled, _ := sim.GetNetworkSetting(home[0], "disabled"); disabled == "1" {
+		t.Errorf("expected home to be enabled again")
+	}
+	if m.State() != WifiStateOnline {
+		t.Errorf("expected to be online, got %s", m.State())
+	}
+}
+
+func TestPortalCheckedWhenReachabilityChanges(t *testing.T) {
+	var fetches int32
+	portal := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&fetches, 1)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer portal.Close()
+
+	m, _ := newSimulatedWifiManagerWithPortal(t,
+		PortalProbe{URL: portal.URL, Status: http.StatusNoContent, Timeout: time.Second},
+		simulatedAccessPoint("home", ScriptConnect("192.168.1.20", time.Millisecond*200)))
+
+	result := m.SetCredentials(&WifiCredentials{SSID: "home", Key: "correct horse", Security: WifiSecurityWPAPSK})
+	if !result.Success || result.Portal == nil || result.Portal.Status != PortalOpen {
+		t.Fatalf("expected to connect to an open network, got %+v", result)
+	}
+
+	// the address loop checked when we came online, and SetCredentials checked again
+	before := atomic.LoadInt32(&fetches)
+	if before != 2 {
+		t.Errorf("expected 2 portal checks while connecting, got %d", before)
+	}
+
+	// a few more reachability probes, which all succeed
+	time.Sleep(time.Second * 3)
+	if after := atomic.LoadInt32(&fetches); after != before {
+		t.Errorf("expected no portal checks while the reachability doesn't change, got %d more", after-before)
+	}
+}
+
+func TestPortalRecheckedWhileCaptive(t *testing.T) {
+	var loggedIn int32
+	portal := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&loggedIn) == 0 {
+			http.Redirect(w, r, "http://portal.example/login", http.StatusFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer portal.Close()
+
+	m, _ := newSimulatedWifiManagerWithPortal(t,
+		PortalProbe{URL: portal.URL, Status: http.StatusNoContent, Timeout: time.Second},
+		simulatedAccessPoint("home", ScriptConnect("192.168.1.20", time.Millisecond*200)))
+
+	result := m.SetCredentials(&WifiCredentials{SSID: "home", Key: "correct horse", Security: WifiSecurityWPAPSK})
+	if result.Portal == nil || result.Portal.Status != PortalCaptive {
+		t.Fatalf("expected a captive portal, got %+v", result)
+	}
+
+	// the reachability probe gets through the portal all along, so only the portal probe can tell
+	atomic.StoreInt32(&loggedIn, 1)
+	time.Sleep(time.Second * 3)
+	if portal := m.Portal(); portal == nil || portal.Status != PortalOpen {
+		t.Errorf("expected the portal to be open once logged in, got %+v", portal)
+	}
+}
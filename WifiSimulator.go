@@ -0,0 +1,462 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SimulatedStep is one step of a scripted connection attempt. After Delay, the address is
+// changed (if Address is set) and then Event is emitted (if set).
+type SimulatedStep struct {
+	Delay     time.Duration
+	Event     string
+	Arguments map[string]string
+	Address   string // SimulatedNoAddress removes the address
+}
+
+const SimulatedNoAddress = "none"
+
+// SimulatedAccessPoint is a network that the simulator can see. Script is replayed whenever
+// a configured network with the same SSID is selected.
+type SimulatedAccessPoint struct {
+	SSID      string
+	BSSID     string
+	Frequency int
+	Signal    int
+	Flags     string
+	Script    []SimulatedStep
+}
+
+// ScriptConnect associates, then gets an address from "dhcp" after dhcpDelay
+func ScriptConnect(address string, dhcpDelay time.Duration) []SimulatedStep {
+	return []SimulatedStep{
+		{Delay: time.Millisecond * 100, Event: "CTRL-EVENT-CONNECTED"},
+		{Delay: dhcpDelay, Address: address},
+	}
+}
+
+// ScriptWrongKey fails the 4-way handshake, as wpa_supplicant does for a bad passphrase
+func ScriptWrongKey() []SimulatedStep {
+	return []SimulatedStep{
+		{Delay: time.Millisecond * 100, Event: "CTRL-EVENT-SSID-TEMP-DISABLED", Arguments: map[string]string{"reason": "WRONG_KEY"}},
+	}
+}
+
+// ScriptNoDHCP associates but never gets an address
+func ScriptNoDHCP() []SimulatedStep {
+	return []SimulatedStep{
+		{Delay: time.Millisecond * 100, Event: "CTRL-EVENT-CONNECTED"},
+	}
+}
+
+// ScriptDrop disconnects after the given delay, to be appended to a connecting script
+func ScriptDrop(after time.Duration) []SimulatedStep {
+	return []SimulatedStep{
+		{Delay: after, Address: SimulatedNoAddress, Event: "CTRL-EVENT-DISCONNECTED"},
+	}
+}
+
+// scriptNotFound is played when the selected network isn't one of the access points
+func scriptNotFound() []SimulatedStep {
+	steps := make([]SimulatedStep, notFoundScanLimit)
+	for i := range steps {
+		steps[i] = SimulatedStep{Delay: time.Millisecond * 100, Event: "CTRL-EVENT-NETWORK-NOT-FOUND"}
+	}
+	return steps
+}
+
+// WifiSimulator is a WifiBackend that keeps its network list in memory and replays scripted
+// events, so that the setup flow can run without a radio.
+type WifiSimulator struct {
+	sync.Mutex
+	accessPoints []SimulatedAccessPoint
+	networks     map[int]map[string]string
+	nextId       int
+	address      string
+	status       map[string]string
+	events       chan WifiEvent
+	cancel       chan bool // closed to stop the script that is playing
+	country      string
+}
+
+func NewWifiSimulator(accessPoints ...SimulatedAccessPoint) *WifiSimulator {
+	return &WifiSimulator{
+		accessPoints: accessPoints,
+		networks:     make(map[int]map[string]string),
+		status:       map[string]string{"wpa_state": "DISCONNECTED"},
+		events:       make(chan WifiEvent, 32),
+	}
+}
+
+// Inject emits an event as if it came from wpa_supplicant
+func (s *WifiSimulator) Inject(name string, arguments map[string]string) {
+	s.Lock()
+	defer s.Unlock()
+	s.emit(name, arguments)
+}
+
+// must be called with the simulator locked
+func (s *WifiSimulator) emit(name string, arguments map[string]string) {
+	if arguments == nil {
+		arguments = make(map[string]string)
+	}
+	switch name {
+	case "CTRL-EVENT-DISCONNECTED":
+		s.status = map[string]string{"wpa_state": "DISCONNECTED"}
+		s.address = ""
+	}
+	s.events <- WifiEvent{name, arguments}
+}
+
+func (s *WifiSimulator) findAccessPoint(ssid string) *SimulatedAccessPoint {
+	for i, ap := range s.accessPoints {
+		if ap.SSID == ssid {
+			return &s.accessPoints[i]
+		}
+	}
+	return nil
+}
+
+// play stops the current script and replays the script for the given network. Must be called with the simulator locked.
+func (s *WifiSimulator) play(id int) {
+	if s.cancel != nil {
+		close(s.cancel)
+		s.cancel = nil
+	}
+	if s.status["wpa_state"] == "COMPLETED" {
+		s.emit("CTRL-EVENT-DISCONNECTED", nil)
+	}
+
+	ssid := strings.Trim(s.networks[id]["ssid"], "\"")
+	ap := s.findAccessPoint(ssid)
+
+	script := scriptNotFound()
+	if ap != nil {
+		script = ap.Script
+	}
+
+	cancel := make(chan bool)
+	s.cancel = cancel
+
+	go func() {
+		for _, step := range script {
+			select {
+			case <-cancel:
+				return
+			case <-time.After(step.Delay):
+			}
+
+			s.Lock()
+			select {
+			case <-cancel:
+				s.Unlock()
+				return
+			default:
+			}
+			switch step.Address {
+			case "":
+			case SimulatedNoAddress:
+				s.address = ""
+			default:
+				s.address = step.Address
+			}
+			if step.Event == "CTRL-EVENT-CONNECTED" && ap != nil {
+				s.status = map[string]string{
+					"wpa_state": "COMPLETED",
+					"id":        strconv.Itoa(id),
+					"ssid":      ap.SSID,
+					"bssid":     ap.BSSID,
+					"freq":      strconv.Itoa(ap.Frequency),
+				}
+			}
+			if step.Event != "" {
+				s.emit(step.Event, step.Arguments)
+			}
+			s.Unlock()
+		}
+	}()
+}
+
+func (s *WifiSimulator) TriggerScan() error {
+	go func() {
+		time.Sleep(time.Millisecond * 500)
+		s.Inject("CTRL-EVENT-SCAN-RESULTS", nil)
+	}()
+	return nil
+}
+
+func (s *WifiSimulator) ScanResults() ([]ScanResult, error) {
+	s.Lock()
+	defer s.Unlock()
+	results := make([]ScanResult, len(s.accessPoints))
+	for i, ap := range s.accessPoints {
+		results[i] = ScanResult{ap.BSSID, ap.Frequency, ap.Signal, ap.Flags, ap.SSID}
+	}
+	return results, nil
+}
+
+func (s *WifiSimulator) Status() (map[string]string, error) {
+	s.Lock()
+	defer s.Unlock()
+	status := make(map[string]string)
+	for k, v := range s.status {
+		status[k] = v
+	}
+	return status, nil
+}
+
+// SignalPoll reports the signal of the access point we're connected to
+func (s *WifiSimulator) SignalPoll() (map[string]string, error) {
+	s.Lock()
+	defer s.Unlock()
+	if s.status["wpa_state"] != "COMPLETED" {
+		return nil, errors.New("FAIL")
+	}
+	ap := s.findAccessPoint(s.status["ssid"])
+	if ap == nil {
+		return nil, errors.New("FAIL")
+	}
+	return map[string]string{
+		"RSSI":      strconv.Itoa(ap.Signal),
+		"LINKSPEED": "65",
+		"NOISE":     "9999",
+		"FREQUENCY": strconv.Itoa(ap.Frequency),
+	}, nil
+}
+
+func (s *WifiSimulator) ListNetworks() ([]int, error) {
+	s.Lock()
+	defer s.Unlock()
+	ids := make([]int, 0, len(s.networks))
+	for id := range s.networks {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	return ids, nil
+}
+
+func (s *WifiSimulator) AddNetwork() (int, error) {
+	s.Lock()
+	defer s.Unlock()
+	id := s.nextId
+	s.nextId++
+	s.networks[id] = map[string]string{"disabled": "1", "priority": "0"}
+	return id, nil
+}
+
+func (s *WifiSimulator) network(id int) (map[string]string, error) {
+	network, ok := s.networks[id]
+	if !ok {
+		return nil, fmt.Errorf("no network with id %d", id)
+	}
+	return network, nil
+}
+
+func (s *WifiSimulator) RemoveNetwork(id int) error {
+	s.Lock()
+	defer s.Unlock()
+	if _, err := s.network(id); err != nil {
+		return err
+	}
+	delete(s.networks, id)
+	if s.status["id"] == strconv.Itoa(id) {
+		s.emit("CTRL-EVENT-DISCONNECTED", nil)
+	}
+	return nil
+}
+
+func (s *WifiSimulator) SetNetworkSettingRaw(id int, name string, value string) error {
+	s.Lock()
+	defer s.Unlock()
+	network, err := s.network(id)
+	if err != nil {
+		return err
+	}
+	network[name] = value
+	return nil
+}
+
+func (s *WifiSimulator) SetNetworkSettingString(id int, name string, value string) error {
+	return s.SetNetworkSettingRaw(id, name, "\""+value+"\"")
+}
+
+func (s *WifiSimulator) GetNetworkSetting(id int, name string) (string, error) {
+	s.Lock()
+	defer s.Unlock()
+	network, err := s.network(id)
+	if err != nil {
+		return "", err
+	}
+	value, ok := network[name]
+	if !ok {
+		return "", errors.New("FAIL")
+	}
+	return value, nil
+}
+
+func (s *WifiSimulator) SelectNetwork(id int) error {
+	s.Lock()
+	defer s.Unlock()
+	if _, err := s.network(id); err != nil {
+		return err
+	}
+	// like wpa_supplicant, selecting a network disables all the others
+	for other, network := range s.networks {
+		if other == id {
+			network["disabled"] = "0"
+		} else {
+			network["disabled"] = "1"
+		}
+	}
+	s.play(id)
+	return nil
+}
+
+func (s *WifiSimulator) EnableNetwork(id int) error {
+	return s.SetNetworkSettingRaw(id, "disabled", "0")
+}
+
+func (s *WifiSimulator) DisableNetwork(id int) error {
+	s.Lock()
+	defer s.Unlock()
+	network, err := s.network(id)
+	if err != nil {
+		return err
+	}
+	network["disabled"] = "1"
+	if s.status["id"] == strconv.Itoa(id) {
+		s.emit("CTRL-EVENT-DISCONNECTED", nil)
+	}
+	return nil
+}
+
+// ReloadConfiguration reconnects to the highest priority enabled network that is in range
+func (s *WifiSimulator) ReloadConfiguration() error {
+	s.Lock()
+	defer s.Unlock()
+
+	// networks in range win, then priority, then the most recently added
+	best, bestPriority, bestInRange := -1, -1, false
+	for id, network := range s.networks {
+		if network["disabled"] == "1" {
+			continue
+		}
+		inRange := s.findAccessPoint(strings.Trim(network["ssid"], "\"")) != nil
+		priority, _ := strconv.Atoi(network["priority"])
+		switch {
+		case best == -1,
+			inRange && !bestInRange,
+			inRange == bestInRange && priority > bestPriority,
+			inRange == bestInRange && priority == bestPriority && id > best:
+			best, bestPriority, bestInRange = id, priority, inRange
+		}
+	}
+
+	if best != -1 {
+		s.play(best)
+	}
+	return nil
+}
+
+func (s *WifiSimulator) SaveConfiguration() error {
+	return nil
+}
+
+func (s *WifiSimulator) SetCountry(country string) error {
+	s.Lock()
+	defer s.Unlock()
+	s.country = country
+	return nil
+}
+
+// StartWPS provisions the first access point that advertises WPS, as if its button had been pressed
+func (s *WifiSimulator) StartWPS() error {
+	s.Lock()
+	defer s.Unlock()
+
+	var ap *SimulatedAccessPoint
+	for i := range s.accessPoints {
+		if strings.Contains(s.accessPoints[i].Flags, "[WPS") {
+			ap = &s.accessPoints[i]
+			break
+		}
+	}
+
+	cancel := make(chan bool)
+	if s.cancel != nil {
+		close(s.cancel)
+	}
+	s.cancel = cancel
+
+	go func() {
+		select {
+		case <-cancel:
+			return
+		case <-time.After(time.Second):
+		}
+
+		s.Lock()
+		defer s.Unlock()
+		select {
+		case <-cancel:
+			return
+		default:
+		}
+		s.cancel = nil
+
+		if ap == nil {
+			s.emit("WPS-TIMEOUT", nil)
+			return
+		}
+
+		id := s.nextId
+		s.nextId++
+		s.networks[id] = map[string]string{
+			"ssid":     "\"" + ap.SSID + "\"",
+			"key_mgmt": "WPA-PSK",
+			"disabled": "0",
+			"priority": "0",
+		}
+		s.emit("WPS-SUCCESS", nil)
+		s.play(id)
+	}()
+
+	return nil
+}
+
+func (s *WifiSimulator) CancelWPS() error {
+	s.Lock()
+	defer s.Unlock()
+	if s.cancel != nil {
+		close(s.cancel)
+		s.cancel = nil
+	}
+	return nil
+}
+
+func (s *WifiSimulator) Events() <-chan WifiEvent {
+	return s.events
+}
+
+func (s *WifiSimulator) Address() (string, error) {
+	s.Lock()
+	defer s.Unlock()
+	if s.address == "" {
+		return "", errors.New("are you connected to the network?")
+	}
+	return s.address, nil
+}
+
+func (s *WifiSimulator) Cleanup() {
+	s.Lock()
+	defer s.Unlock()
+	if s.cancel != nil {
+		close(s.cancel)
+		s.cancel = nil
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import "time"
+
+// how long wlan0 has to be disconnected before ap0 moves to the least congested channel, so that
+// a roam or a quick reconnect doesn't restart the access point twice
+const StationIdleDelay = time.Second * 30
+
+// the 2.4GHz channels that don't overlap each other, preferred when we get to choose
+var nonOverlappingChannels = []int{1, 6, 11}
+
+// APChannelStatus is reported by /status
+type APChannelStatus struct {
+	Wanted   int  `json:"wanted"`   // the channel ap0 should be on, normally the one wlan0 is using
+	Channel  int  `json:"channel"`  // the channel hostapd is configured with
+	Mismatch bool `json:"mismatch"` // the country doesn't allow an access point on the wanted channel, e.g. a DFS channel
+}
+
+// ChannelStatus returns the channel ap0 should be on, and the one it is configured with
+func (a *AccessPointManager) ChannelStatus() APChannelStatus {
+	a.Lock()
+	defer a.Unlock()
+	return APChannelStatus{
+		Wanted:   a.channel,
+		Channel:  a.hostapdChannel,
+		Mismatch: a.hostapdChannel != 0 && a.hostapdChannel != a.channel,
+	}
+}
+
+// Frequency returns the frequency (MHz) of the network wlan0 is associated with
+func (m *WifiManager) Frequency() (int, bool) {
+	status, err := m.Status()
+	if err != nil || status["wpa_state"] != "COMPLETED" {
+		return 0, false
+	}
+	return statusInt(status, "freq")
+}
+
+// SetChannel rewrites the hostapd configuration for the channel, restarting hostapd if it is
+// running on a different one
+func (a *AccessPointManager) SetChannel(channel int) {
+	a.Lock()
+	if channel == a.channel {
+		a.Unlock()
+		return
+	}
+	logger.Infof("Moving ap0 from channel %d to %d", a.channel, channel)
+	a.channel = channel
+	active := a.active
+	a.Unlock()
+
+	a.WriteAPConfig()
+	if active {
+		if err := a.StartHostAP(); err != nil {
+			logger.Errorf("%v", err)
+		}
+	}
+}
+
+// FollowStation keeps ap0 on the channel that wlan0 is using, as single radio chips can only
+// be on one channel at a time. While wlan0 is idle, ap0 uses the least congested channel.
+func (a *AccessPointManager) FollowStation(wifi_manager *WifiManager) {
+	states := wifi_manager.SubscribeState(SubscribeOptions{Buffer: 16, Policy: DropOldest})
+	defer states.Unsubscribe()
+
+	var idle <-chan time.Time
+
+	for {
+		select {
+		case state := <-states.C:
+			switch state {
+			case WifiStateConnected:
+				// a new association, or a roam to another access point
+				idle = nil
+				if freq, ok := wifi_manager.Frequency(); ok {
+					a.SetChannel(frequencyToChannel(freq))
+				}
+			case WifiStateDisconnected:
+				if idle == nil {
+					idle = time.After(StationIdleDelay)
+				}
+			}
+
+		case <-idle:
+			idle = nil
+			if _, connected := wifi_manager.Frequency(); connected {
+				continue
+			}
+			if _, err := wifi_manager.ScanNetworks(BackgroundScanInterval); err != nil {
+				logger.Warningf("FollowStation: Failed to scan: %v", err)
+				continue
+			}
+			results, err := wifi_manager.ScanResults()
+			if err != nil {
+				logger.Warningf("FollowStation: Failed to read scan results: %v", err)
+				continue
+			}
+			a.SetChannel(a.leastCongestedChannel(results))
+		}
+	}
+}
+
+// leastCongestedChannel picks the non-overlapping 2.4GHz channel allowed for an access point
+// that suffers least interference from the access points in the scan results
+func (a *AccessPointManager) leastCongestedChannel(results []ScanResult) int {
+	domain, err := LookupRegulatoryDomain(a.Country())
+	if err != nil {
+		return DefaultAPChannel
+	}
+
+	best, bestCongestion := DefaultAPChannel, -1
+	for _, channel := range nonOverlappingChannels {
+		if !domain.AllowsAPChannel(channel) {
+			continue
+		}
+		congestion := 0
+		for _, result := range results {
+			other := frequencyToChannel(result.Frequency)
+			if other < 1 || other > 14 {
+				continue
+			}
+			// channels 5 apart don't overlap, closer ones interfere more the stronger they are
+			distance := channel - other
+			if distance < 0 {
+				distance = -distance
+			}
+			if distance < 5 {
+				congestion += (5 - distance) * signalQuality(result.Signal)
+			}
+		}
+		if bestCongestion == -1 || congestion < bestCongestion {
+			best, bestCongestion = channel, congestion
+		}
+	}
+
+	logger.Infof("Least congested channel is %d", best)
+	return best
+}
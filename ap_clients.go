@@ -0,0 +1,129 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// hostapd's ctrl_interface (set by WriteAPConfig), where it listens on a socket named after the interface
+const HostapdControlDir = "/var/run/hostapd"
+
+// APClient is a station associated with the AP, along with its dhcp lease if it has one
+type APClient struct {
+	MAC            string    `json:"mac"`
+	IP             string    `json:"ip,omitempty"`
+	Hostname       string    `json:"hostname,omitempty"`
+	ConnectedTime  int       `json:"connectedTime"` // seconds
+	ConnectedSince time.Time `json:"connectedSince"`
+}
+
+// dhcpLease is a line of the dnsmasq lease file
+type dhcpLease struct {
+	Expires  time.Time
+	MAC      string
+	IP       string
+	Hostname string
+}
+
+// readDHCPLeases parses the dnsmasq lease file, keyed by mac address.
+// Each line is "<expiry> <mac> <ip> <hostname or *> <client id or *>".
+func readDHCPLeases(path string) (map[string]dhcpLease, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	leases := make(map[string]dhcpLease)
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 4 {
+			continue
+		}
+		expiry, err := strconv.ParseInt(fields[0], 10, 64)
+		if err != nil {
+			continue
+		}
+		lease := dhcpLease{
+			Expires: time.Unix(expiry, 0),
+			MAC:     strings.ToLower(fields[1]),
+			IP:      fields[2],
+		}
+		if fields[3] != "*" {
+			lease.Hostname = fields[3]
+		}
+		leases[lease.MAC] = lease
+	}
+	return leases, nil
+}
+
+// parseStations parses the output of hostapd's STA-FIRST/STA-NEXT (or hostapd_cli all_sta), where
+// each station is its mac address followed by key=value lines. Returns connected_time by mac.
+func parseStations(raw string) map[string]int {
+	stations := make(map[string]int)
+	current := ""
+	for _, line := range strings.Split(raw, "\n") {
+		line = strings.TrimSpace(line)
+		if _, err := net.ParseMAC(line); err == nil {
+			current = strings.ToLower(line)
+			stations[current] = 0
+			continue
+		}
+		if current == "" {
+			continue
+		}
+		if parts := strings.SplitN(line, "=", 2); len(parts) == 2 && parts[0] == "connected_time" {
+			stations[current], _ = strconv.Atoi(parts[1])
+		}
+	}
+	return stations
+}
+
+// Stations returns the connected time of each station associated with the AP, by mac address
+func (a *AccessPointManager) Stations() (map[string]int, error) {
+	out, err := exec.Command("hostapd_cli", "-p", HostapdControlDir, "-i", a.NetworkInterface, "all_sta").Output()
+	if err != nil {
+		return nil, err
+	}
+	return parseStations(string(out)), nil
+}
+
+// ListClients returns the stations associated with the AP, with their addresses from the dhcp leases
+func (a *AccessPointManager) ListClients() ([]APClient, error) {
+	stations, err := a.Stations()
+	if err != nil {
+		return nil, err
+	}
+
+	leases, err := readDHCPLeases(DnsmasqLeaseFile)
+	if err != nil {
+		// no leases yet, we still know who is associated
+		logger.Debugf("Failed to read %s: %v", DnsmasqLeaseFile, err)
+	}
+
+	now := time.Now()
+	clients := []APClient{}
+	for mac, connected := range stations {
+		client := APClient{
+			MAC:            mac,
+			ConnectedTime:  connected,
+			ConnectedSince: now.Add(-time.Duration(connected) * time.Second),
+		}
+		if lease, ok := leases[mac]; ok {
+			client.IP = lease.IP
+			client.Hostname = lease.Hostname
+		}
+		clients = append(clients, client)
+	}
+
+	// longest connected first
+	sort.SliceStable(clients, func(i, j int) bool {
+		return clients[i].ConnectedTime > clients[j].ConnectedTime
+	})
+
+	return clients, nil
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+)
+
+const (
+	// the package used to install a fixed copy of this, now it is generated from the [dhcp] section
+	DnsmasqConfigFile = "/etc/dnsmasq.conf"
+	DnsmasqLeaseFile  = "/var/run/dnsmasq.leases"
+)
+
+// DnsmasqConfig renders the dnsmasq configuration for the AP from the [dhcp] section
+func (a *AccessPointManager) DnsmasqConfig() (string, error) {
+	dhcp := a.config.DHCP
+
+	for _, ip := range []string{dhcp.Range_Start, dhcp.Range_End} {
+		if parsed := net.ParseIP(ip); parsed == nil || parsed.To4() == nil {
+			return "", fmt.Errorf("invalid dhcp range address: %s", ip)
+		}
+	}
+
+	s := ""
+	s += "interface=" + a.NetworkInterface + "\n"
+	// only answer on the AP (and lo, which dnsmasq always adds with interface=), as the wildcard
+	// below would resolve every name to the sphere for anything else that can reach port 53
+	s += "bind-interfaces\n"
+	s += "no-hosts\n"
+	s += "addn-hosts=/etc/hosts.dnsmasq\n"
+	s += "dhcp-range=" + dhcp.Range_Start + "," + dhcp.Range_End + "," + dhcp.Lease_Time + "\n"
+	s += "log-dhcp\n"
+	s += "dhcp-leasefile=" + DnsmasqLeaseFile + "\n"
+
+	for _, override := range dhcp.DNS_Override {
+		// name=address
+		parts := strings.SplitN(override, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || net.ParseIP(parts[1]) == nil {
+			return "", fmt.Errorf("expected name=address for dns-override, got %q", override)
+		}
+		s += "address=/" + parts[0] + "/" + parts[1] + "\n"
+	}
+
+	if dhcp.Wildcard_DNS && !a.config.Hotspot.Enabled {
+		// every other name resolves to the sphere, so that clients of the setup network find the setup
+		// wizard. hotspot clients need the real answers.
+		s += "address=/#/" + APAddress + "\n"
+	}
+
+	return s, nil
+}
+
+// WriteDnsmasqConfig writes the dnsmasq configuration, restarting dnsmasq if it changed
+func (a *AccessPointManager) WriteDnsmasqConfig() error {
+	s, err := a.DnsmasqConfig()
+	if err != nil {
+		return err
+	}
+
+	if existing, err := ioutil.ReadFile(DnsmasqConfigFile); err == nil && string(existing) == s {
+		return nil
+	}
+
+	if err := ioutil.WriteFile(DnsmasqConfigFile, []byte(s), 0644); err != nil {
+		return err
+	}
+
+	logger.Infof("dnsmasq configuration changed, restarting dnsmasq")
+	if err := a.Services.Restart("dnsmasq"); err != nil {
+		return fmt.Errorf("failed to restart dnsmasq: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+)
+
+const (
+	IPForwardFile = "/proc/sys/net/ipv4/ip_forward"
+	// what ip_forward was before the hotspot turned it on, so that teardown can put it back
+	IPForwardSavedFile = "/var/run/sphere-setup-ip-forward"
+	// ap0's subnet (see /etc/network/interfaces.d/ap0), which is masqueraded. the [dhcp] range has
+	// to be inside it.
+	APSubnet = "172.16.0.0/24"
+	// the most clients we'll make tc classes for
+	MaxShapedClients = 254
+)
+
+// HotspotStatus is reported to the app by get_hotspot
+type HotspotStatus struct {
+	Enabled    bool     `json:"enabled"`
+	Uplink     string   `json:"uplink,omitempty"` // the interface being shared, if any
+	ClientRate string   `json:"clientRate,omitempty"`
+	Allow      []string `json:"allow,omitempty"`
+}
+
+// Hotspot returns whether the uplink is being shared with clients of the AP, and how
+func (a *AccessPointManager) Hotspot() HotspotStatus {
+	a.Lock()
+	defer a.Unlock()
+	return HotspotStatus{
+		Enabled:    a.config.Hotspot.Enabled,
+		Uplink:     a.hotspotUplink,
+		ClientRate: a.config.Hotspot.Client_Rate,
+		Allow:      a.config.Hotspot.Allow,
+	}
+}
+
+// hotspotNAT returns the rules that share the uplink with the clients of the AP
+func (a *AccessPointManager) hotspotNAT(uplink string) (NATRules, error) {
+	nat := NATRules{
+		Inside:  a.NetworkInterface,
+		Outside: uplink,
+		Source:  APSubnet,
+	}
+
+	// clients outside the subnet wouldn't be masqueraded
+	_, subnet, _ := net.ParseCIDR(APSubnet)
+	for _, address := range []string{a.config.DHCP.Range_Start, a.config.DHCP.Range_End} {
+		if ip := net.ParseIP(address); ip == nil || !subnet.Contains(ip) {
+			return nat, fmt.Errorf("the dhcp range %s-%s is outside the access point's subnet %s",
+				a.config.DHCP.Range_Start, a.config.DHCP.Range_End, APSubnet)
+		}
+	}
+	for _, entry := range a.config.Hotspot.Allow {
+		mac, err := net.ParseMAC(strings.TrimSpace(entry))
+		if err != nil {
+			return nat, fmt.Errorf("invalid mac address in the hotspot allow list: %q", entry)
+		}
+		nat.Allow = append(nat.Allow, mac.String())
+	}
+	return nat, nil
+}
+
+// FollowUplink shares whichever uplink is in use with the clients of the AP while hotspot mode
+// is on, following it as it changes. With hotspot mode off it tears down anything left behind
+// by an earlier run, and returns.
+func (a *AccessPointManager) FollowUplink(connectivity *ConnectivityMonitor) {
+	if !a.config.Hotspot.Enabled {
+		if err := a.TeardownHotspot(); err != nil {
+			logger.Warningf("Failed to tear down the hotspot: %v", err)
+		}
+		return
+	}
+
+	// check the allow list before letting anything through
+	if _, err := a.hotspotNAT(""); err != nil {
+		logger.Errorf("Not starting the hotspot: %v", err)
+		return
+	}
+
+	if err := enableIPForward(); err != nil {
+		logger.Errorf("Not starting the hotspot, failed to enable ip forwarding: %v", err)
+		return
+	}
+
+	if rate := a.config.Hotspot.Client_Rate; rate != "" {
+		if err := a.shapeClients(rate); err != nil {
+			logger.Errorf("Failed to limit the hotspot clients to %s: %v", rate, err)
+		}
+	}
+
+	uplinks := connectivity.SubscribeUplink(SubscribeOptions{Policy: Coalesce})
+	defer uplinks.Unsubscribe()
+
+	for range uplinks.C {
+		uplink := connectivity.Uplink().Interface
+
+		a.Lock()
+		current := a.hotspotUplink
+		a.Unlock()
+		if uplink == current {
+			continue
+		}
+
+		var err error
+		if uplink == "" {
+			logger.Infof("No uplink to share with hotspot clients")
+			err = a.Firewall.RemoveNAT()
+		} else {
+			nat, _ := a.hotspotNAT(uplink)
+			err = a.Firewall.ApplyNAT(nat)
+		}
+		if err != nil {
+			logger.Errorf("Failed to share %s with hotspot clients: %v", uplink, err)
+			continue
+		}
+
+		a.Lock()
+		a.hotspotUplink = uplink
+		a.Unlock()
+	}
+}
+
+// TeardownHotspot removes the nat rules and client limits, and puts ip forwarding back the way it was
+func (a *AccessPointManager) TeardownHotspot() error {
+	a.Lock()
+	a.hotspotUplink = ""
+	a.Unlock()
+
+	err := a.Firewall.RemoveNAT()
+
+	// there may not be any, so errors don't matter
+	runWithInput("", "tc", "qdisc", "del", "dev", a.NetworkInterface, "root")
+	runWithInput("", "tc", "qdisc", "del", "dev", a.NetworkInterface, "ingress")
+
+	if restoreErr := restoreIPForward(); restoreErr != nil && err == nil {
+		err = restoreErr
+	}
+	return err
+}
+
+// shapeClients limits each address in the dhcp range to rate (in tc's format, e.g. 2mbit) in
+// both directions. Traffic to the clients is shaped with htb, traffic from them is policed.
+func (a *AccessPointManager) shapeClients(rate string) error {
+	addresses, err := addressRange(a.config.DHCP.Range_Start, a.config.DHCP.Range_End)
+	if err != nil {
+		return err
+	}
+	if len(addresses) > MaxShapedClients {
+		return fmt.Errorf("dhcp range has %d addresses, more than %d", len(addresses), MaxShapedClients)
+	}
+
+	dev := a.NetworkInterface
+	runWithInput("", "tc", "qdisc", "del", "dev", dev, "root")
+	runWithInput("", "tc", "qdisc", "del", "dev", dev, "ingress")
+
+	s := ""
+	s += "qdisc add dev " + dev + " root handle 1: htb default 1\n"
+	// anything that isn't for a client (dhcp replies, the setup wizard) isn't limited
+	s += "class add dev " + dev + " parent 1: classid 1:1 htb rate 1000mbit\n"
+	s += "qdisc add dev " + dev + " handle ffff: ingress\n"
+	for i, ip := range addresses {
+		// tc class ids are hex
+		class := fmt.Sprintf("1:%x", i+0x10)
+		s += "class add dev " + dev + " parent 1: classid " + class + " htb rate " + rate + " ceil " + rate + "\n"
+		s += "filter add dev " + dev + " parent 1: protocol ip prio 1 u32 match ip dst " + ip + "/32 flowid " + class + "\n"
+		s += "filter add dev " + dev + " parent ffff: protocol ip prio 1 u32 match ip src " + ip + "/32 police rate " + rate + " burst 64k drop flowid :1\n"
+	}
+
+	_, err = runWithInput(s, "tc", "-batch", "-")
+	return err
+}
+
+// addressRange returns the ipv4 addresses from start to end, inclusive
+func addressRange(start string, end string) ([]string, error) {
+	first := net.ParseIP(start).To4()
+	last := net.ParseIP(end).To4()
+	if first == nil || last == nil {
+		return nil, fmt.Errorf("invalid address range %s-%s", start, end)
+	}
+
+	from := binary.BigEndian.Uint32(first)
+	to := binary.BigEndian.Uint32(last)
+	if to < from {
+		return nil, fmt.Errorf("invalid address range %s-%s", start, end)
+	}
+
+	addresses := []string{}
+	for n := from; n <= to && len(addresses) <= MaxShapedClients; n++ {
+		ip := make(net.IP, 4)
+		binary.BigEndian.PutUint32(ip, n)
+		addresses = append(addresses, ip.String())
+	}
+	return addresses, nil
+}
+
+// enableIPForward turns on ip forwarding, remembering what it was unless we've already turned it on
+func enableIPForward() error {
+	if _, err := os.Stat(IPForwardSavedFile); os.IsNotExist(err) {
+		previous, err := ioutil.ReadFile(IPForwardFile)
+		if err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(IPForwardSavedFile, previous, 0644); err != nil {
+			return err
+		}
+	}
+	return ioutil.WriteFile(IPForwardFile, []byte("1\n"), 0644)
+}
+
+// restoreIPForward puts ip forwarding back the way it was before enableIPForward, if it was called
+func restoreIPForward() error {
+	previous, err := ioutil.ReadFile(IPForwardSavedFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(IPForwardFile, previous, 0644); err != nil {
+		return err
+	}
+	return os.Remove(IPForwardSavedFile)
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"crypto/rand"
+	"io/ioutil"
+	"math/big"
+	"strings"
+	"time"
+)
+
+// the passphrase generated for this sphere's access point on first boot
+const APKeyFile = "/data/etc/ap-key"
+
+const (
+	// long enough to resist guessing for the time the access point is up, short enough to type from the led matrix
+	APKeyLength = 10
+	// no 0/O, 1/l/I etc., which are hard to tell apart on the led matrix
+	apKeyAlphabet = "abcdefghjkmnpqrstuvwxyz23456789"
+
+	// the led matrix only has room for a pairing code, which is 4 digits
+	LEDCodeWidth = 4
+	// how long each step of the key is shown while it scrolls across the led matrix
+	KeyScrollInterval = time.Millisecond * 700
+	// how many times the key scrolls past
+	KeyScrollPasses = 3
+)
+
+// APCredentials are reported to the app over the authenticated BLE channel
+type APCredentials struct {
+	SSID   string `json:"ssid"`
+	Key    string `json:"key"`
+	Pinned bool   `json:"pinned"` // the key was set in the configuration, rather than generated
+}
+
+// LoadOrCreateAPKey returns this sphere's access point passphrase, generating and saving it the first time
+func LoadOrCreateAPKey() (string, error) {
+	if data, err := ioutil.ReadFile(APKeyFile); err == nil {
+		if key := strings.TrimSpace(string(data)); len(key) >= 8 {
+			return key, nil
+		}
+		logger.Warningf("Ignoring invalid access point key in %s", APKeyFile)
+	}
+
+	key, err := generateAPKey()
+	if err != nil {
+		return "", err
+	}
+
+	logger.Infof("Generated a new access point key")
+	return key, ioutil.WriteFile(APKeyFile, []byte(key+"\n"), 0600)
+}
+
+func generateAPKey() (string, error) {
+	key := make([]byte, APKeyLength)
+	max := big.NewInt(int64(len(apKeyAlphabet)))
+	for i := range key {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		key[i] = apKeyAlphabet[n.Int64()]
+	}
+	return string(key), nil
+}
+
+// Credentials returns the ssid and passphrase of the access point
+func (a *AccessPointManager) Credentials() APCredentials {
+	return APCredentials{
+		SSID:   a.config.Wireless_Host.SSID,
+		Key:    a.key,
+		Pinned: a.config.Wireless_Host.Key != "",
+	}
+}
+
+// ShowAPKey scrolls the key across the led matrix, LEDCodeWidth characters at a time, since the
+// pairing code display doesn't have room for all of it. It returns once the key has scrolled past
+// KeyScrollPasses times.
+func ShowAPKey(pairingUI ConsolePairingUI, key string) {
+	for pass := 0; pass < KeyScrollPasses; pass++ {
+		for _, window := range scrollWindows(key, LEDCodeWidth) {
+			if err := pairingUI.DisplayPairingCode(window); err != nil {
+				logger.Warningf("Failed to show the access point key: %v", err)
+				return
+			}
+			time.Sleep(KeyScrollInterval)
+		}
+		// pause at the end, so that it is clear where the key starts again
+		time.Sleep(KeyScrollInterval * 2)
+	}
+}
+
+// scrollWindows returns the steps of scrolling s through a window of the given width, e.g.
+// "abcdef" in 4 gives "abcd", "bcde" and "cdef"
+func scrollWindows(s string, width int) []string {
+	if len(s) <= width {
+		return []string{s}
+	}
+	windows := make([]string, 0, len(s)-width+1)
+	for i := 0; i+width <= len(s); i++ {
+		windows = append(windows, s[i:i+width])
+	}
+	return windows
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/ninjasphere/go-ninja/api"
+	"github.com/ninjasphere/go-ninja/config"
+)
+
+const (
+	APStationConnected    = "AP-STA-CONNECTED"
+	APStationDisconnected = "AP-STA-DISCONNECTED"
+
+	// how long to wait for hostapd to say something before checking that it is still there
+	hostapdPingInterval = 10 * time.Second
+	// how long to wait before attaching again once hostapd goes away
+	hostapdRetryInterval = 2 * time.Second
+	// how often the idle shutdown looks at the AP
+	APIdleCheckInterval = 30 * time.Second
+)
+
+// APEvent is a station joining or leaving the AP
+type APEvent struct {
+	Event string    `json:"event"` // APStationConnected or APStationDisconnected
+	MAC   string    `json:"mac"`
+	Time  time.Time `json:"time"`
+}
+
+// ParseAPEvent parses an event as delivered by SubscribeStations, e.g. "AP-STA-CONNECTED 02:11:22:33:44:55"
+func ParseAPEvent(s string) (APEvent, error) {
+	fields := strings.Fields(s)
+	if len(fields) < 2 || (fields[0] != APStationConnected && fields[0] != APStationDisconnected) {
+		return APEvent{}, fmt.Errorf("not a station event: %q", s)
+	}
+	if _, err := net.ParseMAC(fields[1]); err != nil {
+		return APEvent{}, fmt.Errorf("invalid station address in %q", s)
+	}
+	return APEvent{fields[0], strings.ToLower(fields[1]), time.Now()}, nil
+}
+
+// hostapdControl is an attached connection to hostapd's control socket
+type hostapdControl struct {
+	conn  *net.UnixConn
+	local string
+}
+
+func attachHostapd(iface string) (*hostapdControl, error) {
+	// hostapd replies to the address we send from, so we need a socket file of our own
+	local := fmt.Sprintf("/tmp/sphere-setup-hostapd-%s-%d", iface, os.Getpid())
+	os.Remove(local)
+
+	conn, err := net.DialUnix("unixgram",
+		&net.UnixAddr{Name: local, Net: "unixgram"},
+		&net.UnixAddr{Name: path.Join(HostapdControlDir, iface), Net: "unixgram"})
+	if err != nil {
+		os.Remove(local)
+		return nil, err
+	}
+
+	c := &hostapdControl{conn, local}
+	if _, err := conn.Write([]byte("ATTACH")); err != nil {
+		c.Close()
+		return nil, err
+	}
+	conn.SetReadDeadline(time.Now().Add(hostapdPingInterval))
+	reply, err := c.read()
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	if reply != "OK" {
+		c.Close()
+		return nil, fmt.Errorf("ATTACH failed: %s", reply)
+	}
+	return c, nil
+}
+
+func (c *hostapdControl) read() (string, error) {
+	buf := make([]byte, 4096)
+	n, err := c.conn.Read(buf)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(buf[:n])), nil
+}
+
+// next returns the next event, without its "<level>" prefix. Replies to our PINGs are skipped.
+// If hostapd has gone quiet for too long it is pinged, and an error is returned if it has gone away.
+func (c *hostapdControl) next() (string, error) {
+	for {
+		c.conn.SetReadDeadline(time.Now().Add(hostapdPingInterval))
+		msg, err := c.read()
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				if _, err := c.conn.Write([]byte("PING")); err != nil {
+					return "", err
+				}
+				continue
+			}
+			return "", err
+		}
+		if msg == "PONG" {
+			continue
+		}
+		if strings.HasPrefix(msg, "<") {
+			if end := strings.Index(msg, ">"); end != -1 {
+				msg = msg[end+1:]
+			}
+		}
+		return msg, nil
+	}
+}
+
+func (c *hostapdControl) Close() {
+	c.conn.Write([]byte("DETACH"))
+	c.conn.Close()
+	os.Remove(c.local)
+}
+
+// SubscribeStations returns a subscription to the stations joining and leaving the AP, as
+// strings that ParseAPEvent understands
+func (a *AccessPointManager) SubscribeStations(opts SubscribeOptions) *StateSubscription {
+	opts.NoReplay = true
+	return a.stationEvents.Subscribe(opts)
+}
+
+// StationCount returns the number of stations hostapd has told us about
+func (a *AccessPointManager) StationCount() int {
+	a.Lock()
+	defer a.Unlock()
+	return len(a.stations)
+}
+
+// MonitorStations follows hostapd's station events while the AP is running, attaching again
+// whenever hostapd is restarted. It never returns.
+func (a *AccessPointManager) MonitorStations() {
+	for {
+		a.Lock()
+		active := a.active
+		a.Unlock()
+
+		if !active {
+			time.Sleep(hostapdRetryInterval)
+			continue
+		}
+
+		ctl, err := attachHostapd(a.NetworkInterface)
+		if err != nil {
+			// hostapd takes a moment to create its socket after being started
+			logger.Debugf("Could not attach to hostapd: %v", err)
+			time.Sleep(hostapdRetryInterval)
+			continue
+		}
+		logger.Infof("Attached to hostapd on %s", a.NetworkInterface)
+
+		// we may have missed some while we weren't attached
+		stations, err := a.Stations()
+		a.Lock()
+		if err == nil {
+			a.stations = make(map[string]bool)
+			for mac := range stations {
+				a.stations[mac] = true
+			}
+		}
+		// we couldn't see what happened while we weren't attached, so the idle time starts now
+		a.attached = true
+		a.lastActivity = time.Now()
+		a.Unlock()
+
+		for {
+			msg, err := ctl.next()
+			if err != nil {
+				logger.Infof("Lost hostapd on %s: %v", a.NetworkInterface, err)
+				break
+			}
+			event, err := ParseAPEvent(msg)
+			if err != nil {
+				continue
+			}
+			a.stationEvent(event)
+			a.stationEvents.Emit(event.Event + " " + event.MAC)
+		}
+		a.Lock()
+		a.attached = false
+		a.Unlock()
+		ctl.Close()
+	}
+}
+
+func (a *AccessPointManager) stationEvent(event APEvent) {
+	a.Lock()
+	defer a.Unlock()
+
+	if event.Event == APStationConnected {
+		a.stations[event.MAC] = true
+	} else {
+		delete(a.stations, event.MAC)
+	}
+	a.lastActivity = event.Time
+	logger.Infof("%s %s (%d stations)", event.Event, event.MAC, len(a.stations))
+}
+
+// StopWhenIdle stops the AP once nobody has been connected to it for the given time, then sends on
+// stopped. Only the time that MonitorStations has been attached to hostapd counts, as stations
+// could come and go unseen otherwise. It never returns.
+func (a *AccessPointManager) StopWhenIdle(timeout time.Duration, stopped chan<- bool) {
+	for range time.Tick(APIdleCheckInterval) {
+		a.Lock()
+		idle := a.active && a.attached && len(a.stations) == 0 && time.Since(a.lastActivity) >= timeout
+		a.Unlock()
+
+		if idle {
+			logger.Infof("Nobody has used the access point for %s, stopping it", timeout)
+			if err := a.StopHostAP(); err != nil {
+				logger.Errorf("%v", err)
+			}
+			select {
+			case stopped <- true:
+			default:
+				// already told
+			}
+		}
+	}
+}
+
+// publishAPEvents publishes stations joining and leaving the AP over mqtt
+func publishAPEvents(conn *ninja.Connection, apManager *AccessPointManager) {
+	topic := fmt.Sprintf("$node/%s/wifi/ap-station", config.Serial())
+
+	events := apManager.SubscribeStations(SubscribeOptions{Buffer: 32, Policy: DropOldest})
+	defer events.Unsubscribe()
+
+	for s := range events.C {
+		event, err := ParseAPEvent(s)
+		if err != nil {
+			continue
+		}
+		if err := conn.SendNotification(topic, event); err != nil {
+			logger.Warningf("Failed to publish %s: %v", event.Event, err)
+		}
+	}
+}
@@ -12,8 +12,43 @@ type AssistantConfig struct {
 		Key                 string
 		Full_Network_Access bool
 		Always_Active       bool
+		Idle_Timeout        int // seconds without any stations before the AP is stopped, 0 to keep it running
 		Enables_Control     bool
 	}
+	DHCP struct {
+		Range_Start  string   // the first address handed out on the AP
+		Range_End    string   // the last
+		Lease_Time   string   // in dnsmasq's format, e.g. 12h
+		DNS_Override []string // name=address, answered by dnsmasq for clients of the AP
+		Wildcard_DNS bool     // answer every other name with the AP's address, for the setup wizard
+	}
+	Hotspot struct {
+		Enabled     bool     // share the uplink with clients of the AP, which is then always active
+		Client_Rate string   // the bandwidth of each client in each direction, in tc's format (e.g. 2mbit). empty for no limit.
+		Allow       []string // mac addresses allowed through, empty for everyone
+	}
+	Services struct {
+		Manager string // "upstart", "systemd" or "auto"
+	}
+	Regulatory struct {
+		Country string // ISO 3166-1 alpha2 country code, or 00 for the world regulatory domain
+	}
+	Firewall struct {
+		Backend string // "iptables", "nftables" or "auto"
+		Preset  string // "setup", "demo" or "developer", see firewallPresets
+	}
+	// allow lists that replace the preset's, by interface
+	Firewall_Interface map[string]*struct {
+		Allow []string // "protocol[/port[:port]] [from cidr]", or "all"
+	}
+	Connectivity struct {
+		Probe_Address  string // host:port that we try to open a tcp connection to
+		Probe_Interval int    // seconds between probes while we have an address
+		Probe_Timeout  int    // seconds
+		Portal_URL     string // url fetched to detect captive portals, empty to disable
+		Portal_Status  int    // the status code expected from portal-url
+		Portal_Content string // the body expected from portal-url, if any
+	}
 }
 
 func LoadConfig(path string) AssistantConfig {
@@ -22,13 +57,31 @@ func LoadConfig(path string) AssistantConfig {
 	// defaults
 	uniqueSuffix, _ := exec.Command("/bin/sh", "-c", "/opt/ninjablocks/bin/sphere-go-serial | sha256sum | cut -c1-8").Output()
 	cfg.Wireless_Host.SSID = "NinjaSphere-" + string(uniqueSuffix)
-	cfg.Wireless_Host.Key = "ninjasphere"
+	cfg.Wireless_Host.Key = "" // generated for each sphere, see LoadOrCreateAPKey
 	cfg.Wireless_Host.Full_Network_Access = false
 	cfg.Wireless_Host.Always_Active = false
+	cfg.Wireless_Host.Idle_Timeout = 600
 	cfg.Wireless_Host.Enables_Control = false
+	cfg.DHCP.Range_Start = "172.16.0.50"
+	cfg.DHCP.Range_End = "172.16.0.150"
+	cfg.DHCP.Lease_Time = "12h"
+	cfg.DHCP.Wildcard_DNS = true
+	cfg.Services.Manager = "auto"
+	cfg.Regulatory.Country = WorldCountry
+	cfg.Firewall.Backend = "auto"
+	cfg.Connectivity.Probe_Address = "8.8.8.8:53"
+	cfg.Connectivity.Probe_Interval = 60
+	cfg.Connectivity.Probe_Timeout = 5
+	cfg.Connectivity.Portal_URL = "http://connectivitycheck.gstatic.com/generate_204"
+	cfg.Connectivity.Portal_Status = 204
 
 	// load from config file (optionally)
 	gcfg.ReadFileInto(&cfg, path)
 
+	// a hotspot that comes and goes isn't much use
+	if cfg.Hotspot.Enabled {
+		cfg.Wireless_Host.Always_Active = true
+	}
+
 	return cfg
 }
@@ -0,0 +1,338 @@
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+const (
+	// the iptables chain that holds our rules, jumped to from INPUT
+	FirewallChain = "SPHERE-SETUP"
+	// the iptables chains that hold the hotspot's rules, jumped to from FORWARD and POSTROUTING
+	FirewallForwardChain = "SPHERE-SETUP-FWD"
+	FirewallNATChain     = "SPHERE-SETUP-NAT"
+	// the nftables table that holds our rules
+	FirewallTable = "sphere_setup"
+	// the nftables table that holds the hotspot's rules. nat needs the ip family on older kernels.
+	FirewallNATTable = "sphere_setup_nat"
+)
+
+// newFirewallBackend returns the named backend, or for "auto" (or nothing), whichever is installed
+func newFirewallBackend(name string) (FirewallBackend, error) {
+	switch name {
+	case "iptables":
+		return newIptablesBackend()
+	case "nftables":
+		return newNftablesBackend()
+	case "", "auto":
+		if backend, err := newIptablesBackend(); err == nil {
+			return backend, nil
+		}
+		return newNftablesBackend()
+	default:
+		return nil, fmt.Errorf("unknown firewall backend: %s", name)
+	}
+}
+
+// newFirewallRenderer returns the named backend for rendering rules only, which doesn't need its
+// commands to be installed
+func newFirewallRenderer(name string) (FirewallBackend, error) {
+	switch name {
+	case "nftables":
+		return &nftablesBackend{}, nil
+	case "iptables", "", "auto":
+		return &iptablesBackend{}, nil
+	default:
+		return nil, fmt.Errorf("unknown firewall backend: %s", name)
+	}
+}
+
+// runWithInput runs a command, feeding it input, and includes its output in any error
+func runWithInput(input string, path string, args ...string) (string, error) {
+	cmd := exec.Command(path, args...)
+	if input != "" {
+		cmd.Stdin = strings.NewReader(input)
+	}
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return string(out), fmt.Errorf("%s %s: %v: %s", path, strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	return string(out), nil
+}
+
+// isNotExist returns true if a runWithInput error says that the table or chain isn't there
+func isNotExist(err error) bool {
+	msg := err.Error()
+	for _, missing := range []string{
+		"No such file or directory",          // nft
+		"No chain/target/match by that name", // iptables
+		"does not exist",                     // iptables, for a table
+	} {
+		if strings.Contains(msg, missing) {
+			return true
+		}
+	}
+	return false
+}
+
+// iptablesBackend keeps our rules in FirewallChain, replacing them with iptables-restore
+type iptablesBackend struct {
+	iptables string
+	restore  string
+}
+
+func newIptablesBackend() (FirewallBackend, error) {
+	iptables, err := exec.LookPath("iptables")
+	if err != nil {
+		return nil, err
+	}
+	restore, err := exec.LookPath("iptables-restore")
+	if err != nil {
+		return nil, err
+	}
+	return &iptablesBackend{iptables, restore}, nil
+}
+
+func (b *iptablesBackend) Name() string {
+	return "iptables"
+}
+
+// Render produces the rules as `iptables -S` lists them
+func (b *iptablesBackend) Render(rules []FirewallRule) []string {
+	lines := []string{}
+	for _, rule := range rules {
+		s := "-A " + FirewallChain
+		if rule.Source != "" {
+			s += " -s " + rule.Source
+		}
+		if rule.Interface != "" {
+			s += " -i " + rule.Interface
+		}
+		if rule.Protocol != "" {
+			s += " -p " + rule.Protocol
+			if rule.Ports != "" {
+				s += " -m " + rule.Protocol + " --dport " + rule.Ports
+			}
+		}
+		if rule.State != "" {
+			s += " -m conntrack --ctstate " + iptablesStates(rule.State)
+		}
+		s += " -j " + strings.ToUpper(rule.Action)
+		lines = append(lines, s)
+	}
+	return lines
+}
+
+// iptablesStates converts conntrack states to the order `iptables -S` lists them in, e.g.
+// "established,related" to "RELATED,ESTABLISHED"
+func iptablesStates(states string) string {
+	listed := []string{}
+	for _, state := range []string{"INVALID", "NEW", "RELATED", "ESTABLISHED", "UNTRACKED"} {
+		for _, s := range strings.Split(states, ",") {
+			if strings.ToUpper(s) == state {
+				listed = append(listed, state)
+			}
+		}
+	}
+	return strings.Join(listed, ",")
+}
+
+func (b *iptablesBackend) Current() ([]string, error) {
+	out, err := runWithInput("", b.iptables, "-S", FirewallChain)
+	if err != nil {
+		return nil, err
+	}
+	rules := []string{}
+	for _, line := range splitLines(out) {
+		if strings.HasPrefix(line, "-A ") {
+			rules = append(rules, line)
+		}
+	}
+	return rules, nil
+}
+
+// Apply flushes and refills our chain in one iptables-restore transaction, leaving the other chains alone
+func (b *iptablesBackend) Apply(rules []FirewallRule) error {
+	s := "*filter\n"
+	s += ":" + FirewallChain + " - [0:0]\n"
+	s += "-F " + FirewallChain + "\n"
+	if _, err := runWithInput("", b.iptables, "-C", "INPUT", "-j", FirewallChain); err != nil {
+		// not hooked up yet
+		s += "-I INPUT 1 -j " + FirewallChain + "\n"
+	}
+	for _, line := range b.Render(rules) {
+		s += line + "\n"
+	}
+	s += "COMMIT\n"
+
+	_, err := runWithInput(s, b.restore, "--noflush")
+	return err
+}
+
+// ApplyNAT refills the forward and nat chains in one iptables-restore transaction
+func (b *iptablesBackend) ApplyNAT(nat NATRules) error {
+	s := "*filter\n"
+	s += ":" + FirewallForwardChain + " - [0:0]\n"
+	s += "-F " + FirewallForwardChain + "\n"
+	if _, err := runWithInput("", b.iptables, "-C", "FORWARD", "-j", FirewallForwardChain); err != nil {
+		s += "-I FORWARD 1 -j " + FirewallForwardChain + "\n"
+	}
+	s += "-A " + FirewallForwardChain + " -i " + nat.Outside + " -o " + nat.Inside + " -m state --state RELATED,ESTABLISHED -j ACCEPT\n"
+	if len(nat.Allow) == 0 {
+		s += "-A " + FirewallForwardChain + " -i " + nat.Inside + " -o " + nat.Outside + " -j ACCEPT\n"
+	}
+	for _, mac := range nat.Allow {
+		s += "-A " + FirewallForwardChain + " -i " + nat.Inside + " -o " + nat.Outside + " -m mac --mac-source " + mac + " -j ACCEPT\n"
+	}
+	s += "-A " + FirewallForwardChain + " -i " + nat.Inside + " -j DROP\n"
+	s += "COMMIT\n"
+
+	s += "*nat\n"
+	s += ":" + FirewallNATChain + " - [0:0]\n"
+	s += "-F " + FirewallNATChain + "\n"
+	if _, err := runWithInput("", b.iptables, "-t", "nat", "-C", "POSTROUTING", "-j", FirewallNATChain); err != nil {
+		s += "-I POSTROUTING 1 -j " + FirewallNATChain + "\n"
+	}
+	s += "-A " + FirewallNATChain + " -s " + nat.Source + " -o " + nat.Outside + " -j MASQUERADE\n"
+	s += "COMMIT\n"
+
+	_, err := runWithInput(s, b.restore, "--noflush")
+	return err
+}
+
+// RemoveNAT unhooks and deletes the forward and nat chains. They may not exist, so errors are ignored
+// until the end, where the chains must be gone.
+func (b *iptablesBackend) RemoveNAT() error {
+	runWithInput("", b.iptables, "-D", "FORWARD", "-j", FirewallForwardChain)
+	runWithInput("", b.iptables, "-F", FirewallForwardChain)
+	runWithInput("", b.iptables, "-X", FirewallForwardChain)
+	runWithInput("", b.iptables, "-t", "nat", "-D", "POSTROUTING", "-j", FirewallNATChain)
+	runWithInput("", b.iptables, "-t", "nat", "-F", FirewallNATChain)
+	runWithInput("", b.iptables, "-t", "nat", "-X", FirewallNATChain)
+
+	if _, err := runWithInput("", b.iptables, "-S", FirewallForwardChain); err == nil {
+		return fmt.Errorf("%s is still there", FirewallForwardChain)
+	} else if !isNotExist(err) {
+		return err
+	}
+	if _, err := runWithInput("", b.iptables, "-t", "nat", "-S", FirewallNATChain); err == nil {
+		return fmt.Errorf("%s is still there", FirewallNATChain)
+	} else if !isNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// nftablesBackend keeps our rules in an input chain of FirewallTable, replacing the table with nft -f
+type nftablesBackend struct {
+	nft string
+}
+
+func newNftablesBackend() (FirewallBackend, error) {
+	nft, err := exec.LookPath("nft")
+	if err != nil {
+		return nil, err
+	}
+	return &nftablesBackend{nft}, nil
+}
+
+func (b *nftablesBackend) Name() string {
+	return "nftables"
+}
+
+// Render produces the rules as `nft list chain` lists them
+func (b *nftablesBackend) Render(rules []FirewallRule) []string {
+	lines := []string{}
+	for _, rule := range rules {
+		parts := []string{}
+		if rule.Interface != "" {
+			parts = append(parts, "iifname \""+rule.Interface+"\"")
+		}
+		if rule.Source != "" {
+			parts = append(parts, "ip saddr "+rule.Source)
+		}
+		if rule.Protocol != "" {
+			if rule.Ports != "" {
+				parts = append(parts, rule.Protocol+" dport "+strings.Replace(rule.Ports, ":", "-", 1))
+			} else {
+				parts = append(parts, "meta l4proto "+rule.Protocol)
+			}
+		}
+		if rule.State != "" {
+			parts = append(parts, "ct state "+rule.State)
+		}
+		parts = append(parts, rule.Action)
+		lines = append(lines, strings.Join(parts, " "))
+	}
+	return lines
+}
+
+func (b *nftablesBackend) Current() ([]string, error) {
+	out, err := runWithInput("", b.nft, "list", "chain", "inet", FirewallTable, "input")
+	if err != nil {
+		return nil, err
+	}
+	rules := []string{}
+	for _, line := range splitLines(out) {
+		switch {
+		case strings.HasPrefix(line, "table "), strings.HasPrefix(line, "chain "),
+			strings.HasPrefix(line, "type "), line == "}":
+		default:
+			rules = append(rules, line)
+		}
+	}
+	return rules, nil
+}
+
+// Apply replaces our table in one transaction. Declaring the table first means the delete can't
+// fail when it doesn't exist yet.
+func (b *nftablesBackend) Apply(rules []FirewallRule) error {
+	s := "table inet " + FirewallTable + "\n"
+	s += "delete table inet " + FirewallTable + "\n"
+	s += "table inet " + FirewallTable + " {\n"
+	s += "\tchain input {\n"
+	s += "\t\ttype filter hook input priority 0; policy accept;\n"
+	for _, line := range b.Render(rules) {
+		s += "\t\t" + line + "\n"
+	}
+	s += "\t}\n"
+	s += "}\n"
+
+	_, err := runWithInput(s, b.nft, "-f", "-")
+	return err
+}
+
+// ApplyNAT replaces the nat table in one transaction, as Apply does for our input rules
+func (b *nftablesBackend) ApplyNAT(nat NATRules) error {
+	s := "table ip " + FirewallNATTable + "\n"
+	s += "delete table ip " + FirewallNATTable + "\n"
+	s += "table ip " + FirewallNATTable + " {\n"
+	s += "\tchain forward {\n"
+	s += "\t\ttype filter hook forward priority 0; policy accept;\n"
+	s += "\t\tiifname \"" + nat.Outside + "\" oifname \"" + nat.Inside + "\" ct state established,related accept\n"
+	if len(nat.Allow) == 0 {
+		s += "\t\tiifname \"" + nat.Inside + "\" oifname \"" + nat.Outside + "\" accept\n"
+	}
+	for _, mac := range nat.Allow {
+		s += "\t\tiifname \"" + nat.Inside + "\" oifname \"" + nat.Outside + "\" ether saddr " + mac + " accept\n"
+	}
+	s += "\t\tiifname \"" + nat.Inside + "\" drop\n"
+	s += "\t}\n"
+	s += "\tchain postrouting {\n"
+	s += "\t\ttype nat hook postrouting priority 100; policy accept;\n"
+	s += "\t\tip saddr " + nat.Source + " oifname \"" + nat.Outside + "\" masquerade\n"
+	s += "\t}\n"
+	s += "}\n"
+
+	_, err := runWithInput(s, b.nft, "-f", "-")
+	return err
+}
+
+// RemoveNAT deletes the nat table, if there is one
+func (b *nftablesBackend) RemoveNAT() error {
+	if _, err := runWithInput("", b.nft, "delete", "table", "ip", FirewallNATTable); err != nil && !isNotExist(err) {
+		return err
+	}
+	return nil
+}
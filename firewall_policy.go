@@ -0,0 +1,162 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	FirewallPresetSetup     = "setup"     // just what the app and the setup wizard need
+	FirewallPresetDemo      = "demo"      // anything goes on the AP, for demo units with a pinned key
+	FirewallPresetDeveloper = "developer" // setup, plus ssh
+)
+
+// an allow list entry that lets everything through
+const FirewallAllowAll = "all"
+
+// the allow lists of the presets, by interface
+var firewallPresets = map[string]map[string][]string{
+	FirewallPresetSetup: {
+		"ap0": {"tcp/80", "tcp/8888", "tcp/9001", "udp/67:68", "udp/53", "tcp/53"},
+	},
+	FirewallPresetDemo: {
+		"ap0": {FirewallAllowAll},
+	},
+	FirewallPresetDeveloper: {
+		"ap0": {"tcp/80", "tcp/8888", "tcp/9001", "udp/67:68", "udp/53", "tcp/53", "tcp/22"},
+	},
+}
+
+// FirewallPolicy is the allow list for each interface that we manage. Anything else arriving on
+// those interfaces is dropped, other interfaces are left alone.
+type FirewallPolicy struct {
+	Preset     string              `json:"preset"`
+	Interfaces map[string][]string `json:"interfaces"`
+}
+
+// LoadFirewallPolicy starts with the configured preset, and replaces the allow lists of any
+// interfaces that have a [firewall-interface "name"] section
+func LoadFirewallPolicy(config AssistantConfig) (*FirewallPolicy, error) {
+	preset := config.Firewall.Preset
+	if preset == "" {
+		preset = FirewallPresetSetup
+		if config.Wireless_Host.Full_Network_Access {
+			preset = FirewallPresetDemo
+		}
+	}
+
+	interfaces, ok := firewallPresets[preset]
+	if !ok {
+		return nil, fmt.Errorf("unknown firewall preset: %s", preset)
+	}
+
+	policy := &FirewallPolicy{
+		Preset:     preset,
+		Interfaces: make(map[string][]string),
+	}
+	for iface, allow := range interfaces {
+		policy.Interfaces[iface] = allow
+	}
+	for iface, section := range config.Firewall_Interface {
+		if section != nil {
+			policy.Interfaces[iface] = section.Allow
+		}
+	}
+
+	// make sure the whole policy is valid before we use any of it
+	if _, err := policy.Rules(); err != nil {
+		return nil, err
+	}
+
+	return policy, nil
+}
+
+// Rules turns the allow lists into firewall rules, interfaces in name order
+func (p *FirewallPolicy) Rules() ([]FirewallRule, error) {
+	names := make([]string, 0, len(p.Interfaces))
+	for iface := range p.Interfaces {
+		names = append(names, iface)
+	}
+	sort.Strings(names)
+
+	rules := []FirewallRule{}
+	for _, iface := range names {
+		// replies to connections the sphere made itself (dns, ntp, the cloud) get through whatever is allowed
+		rules = append(rules, FirewallRule{Interface: iface, State: FirewallEstablished, Action: FirewallAccept})
+
+		allowAll := false
+		for _, entry := range p.Interfaces[iface] {
+			if strings.TrimSpace(entry) == FirewallAllowAll {
+				allowAll = true
+				continue
+			}
+			rule, err := parseAllowEntry(iface, entry)
+			if err != nil {
+				return nil, fmt.Errorf("firewall policy for %s: %v", iface, err)
+			}
+			rules = append(rules, rule)
+		}
+		if !allowAll {
+			rules = append(rules, FirewallRule{Interface: iface, Action: FirewallDrop})
+		}
+	}
+	return rules, nil
+}
+
+// parseAllowEntry parses "protocol[/port[:port]] [from cidr]", e.g. "tcp/22 from 192.168.0.0/16" or "icmp"
+func parseAllowEntry(iface string, entry string) (FirewallRule, error) {
+	rule := FirewallRule{Interface: iface, Action: FirewallAccept}
+
+	fields := strings.Fields(entry)
+	switch {
+	case len(fields) == 1:
+	case len(fields) == 3 && fields[1] == "from":
+		ip, ipnet, err := net.ParseCIDR(fields[2])
+		if err != nil {
+			return rule, fmt.Errorf("invalid source range in %q", entry)
+		}
+		if ip.To4() == nil {
+			// the rules only go in the ipv4 tables
+			return rule, fmt.Errorf("only ipv4 source ranges are supported, got %q", entry)
+		}
+		// as the backends list it, e.g. 192.168.1.7/24 is listed as 192.168.1.0/24
+		rule.Source = ipnet.String()
+	default:
+		return rule, fmt.Errorf("expected protocol[/port] [from cidr], got %q", entry)
+	}
+
+	parts := strings.SplitN(fields[0], "/", 2)
+	switch parts[0] {
+	case "tcp", "udp":
+	case "icmp":
+		if len(parts) == 2 {
+			return rule, fmt.Errorf("icmp has no ports, got %q", entry)
+		}
+	default:
+		return rule, fmt.Errorf("expected tcp, udp or icmp in %q", entry)
+	}
+	rule.Protocol = parts[0]
+
+	if len(parts) == 1 {
+		// every port
+		return rule, nil
+	}
+
+	ports := []int{}
+	for _, port := range strings.SplitN(parts[1], ":", 2) {
+		n, err := strconv.Atoi(port)
+		if err != nil || n < 1 || n > 65535 {
+			return rule, fmt.Errorf("invalid port in %q", entry)
+		}
+		ports = append(ports, n)
+	}
+	if len(ports) == 2 && ports[0] > ports[1] {
+		return rule, fmt.Errorf("the first port is after the last in %q", entry)
+	}
+	rule.Ports = parts[1]
+
+	return rule, nil
+}
@@ -1,6 +1,9 @@
 package main
 
-import "encoding/json"
+import (
+	"encoding/json"
+	"errors"
+)
 
 type JSONRPCError struct {
 	Code    int         `json:"code"`
@@ -72,3 +75,15 @@ func (r *JSONRPCRouter) CallRaw(request []byte) chan []byte {
 	}()
 	return bytes_response
 }
+
+// DecodeParams unmarshals the first positional parameter of the request into v
+func (request *JSONRPCRequest) DecodeParams(v interface{}) error {
+	if len(request.Params) == 0 {
+		return errors.New("missing parameters")
+	}
+	b, err := json.Marshal(request.Params[0])
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
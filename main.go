@@ -22,6 +22,7 @@ const WirelessNetworkInterface = "wlan0"
 const WirelessStaleTimeout = time.Second * 30 // FIXME: INCREASE THIS. a few minutes at least when not in testing.
 
 var firewallHook = flag.Bool("firewall-hook", false, "Sets up the firewall based on configuration options, and nothing else.")
+var firewallDryRun = flag.Bool("dry-run", false, "With -firewall-hook, prints the planned firewall rules instead of applying them.")
 var factoryReset = false
 var imagesDir = ""
 
@@ -45,7 +46,12 @@ func main() {
 
 	if *firewallHook {
 		logger.Debugf("Setting ip firewall rules...")
-		apManager.SetupFirewall()
+		apManager.Firewall.DryRun = *firewallDryRun
+		if err := apManager.SetupFirewall(); err != nil {
+			// fails hostapd's pre-start, rather than bringing ap0 up without its firewall
+			logger.Errorf("Failed to set up the firewall: %v", err)
+			os.Exit(1)
+		}
 		return
 	}
 
@@ -59,6 +65,9 @@ func main() {
 		logger.Errorf("BLE failed to start: %s", err)
 	}
 
+	// the reset button can ask for wps, which is handled by the main loop once the wifi manager is up
+	wpsRequests := make(chan bool, 1)
+
 	startResetMonitor(func(m *model.ResetMode) {
 		if pairing_ui == nil || controlChecker == nil {
 			return
@@ -71,23 +80,69 @@ func main() {
 		} else {
 			restartHeartbeat = controlChecker.StopHeartbeat()
 		}
-		pairing_ui.DisplayResetMode(m)
-	})
+		if color, ok := modeColors[m.Mode]; ok {
+			pairing_ui.DisplayColorHint(color)
+		} else {
+			pairing_ui.DisplayResetMode(m)
+		}
+	}, map[string]func(){
+		"wps": func() {
+			select {
+			case wpsRequests <- true:
+			default:
+				// already asked
+			}
+		},
+		"show-key": func() {
+			if pairing_ui != nil {
+				// don't hold up the reset button while the key scrolls past
+				go ShowAPKey(pairing_ui, apManager.Credentials().Key)
+			}
+		},
+	}, apManager.Services)
 
 	apManager.WriteAPConfig()
+	if err := apManager.WriteDnsmasqConfig(); err != nil {
+		logger.Errorf("Failed to write the dnsmasq configuration: %v", err)
+	}
 	if config.Wireless_Host.Always_Active {
-		apManager.StartHostAP()
+		if err := apManager.StartHostAP(); err != nil {
+			logger.Errorf("%v", err)
+		}
 	} else {
-		apManager.StopHostAP()
+		if err := apManager.StopHostAP(); err != nil {
+			logger.Errorf("%v", err)
+		}
 	}
 
 	// wlan0 client management
-	wifi_manager, err := NewWifiManager(WirelessNetworkInterface)
+	wifi_manager, err := NewWifiManager(WirelessNetworkInterface, config)
 	if err != nil {
 		log.Fatal("Could not setup manager for wlan0, does the interface exist?: %v", err)
 	}
 	defer wifi_manager.Cleanup()
 
+	// make sure wpa_supplicant uses the same regulatory domain as the access point
+	if err := wifi_manager.SetCountry(apManager.Country()); err != nil {
+		logger.Warningf("Failed to set the country to %s: %v", apManager.Country(), err)
+	}
+
+	// follow stations joining and leaving ap0, and stop it when nobody is using it
+	go apManager.MonitorStations()
+	apIdle := make(chan bool, 1)
+	if !config.Wireless_Host.Always_Active && config.Wireless_Host.Idle_Timeout > 0 {
+		go apManager.StopWhenIdle(time.Duration(config.Wireless_Host.Idle_Timeout)*time.Second, apIdle)
+	}
+
+	// single radio, so ap0 has to be on whatever channel wlan0 is using
+	go apManager.FollowStation(wifi_manager)
+
+	// wired uplinks count as connectivity too, so that we don't start pairing while online over ethernet
+	connectivity := NewConnectivityMonitor(wifi_manager, config)
+
+	// with hotspot mode on, share the uplink with clients of ap0, otherwise clean up after it
+	go apManager.FollowUplink(connectivity)
+
 	// When in reset mode, this will talk to the led matrix directly,
 	// otherwise, it will use sphere-go-led-controller via mqtt.
 	pairing_ui, err = NewPairingUI()
@@ -127,15 +182,21 @@ func main() {
 		if err != nil {
 			logger.FatalErrorf(err, "Failed to connect to mqtt")
 		}
+
+		go publishLinkQuality(conn, wifi_manager)
+		go publishAPEvents(conn, apManager)
 	}
 
 	// start by registering the RPC functions that will be accessible
 	// once the client has authenticated
 	// We pass in the ble server so that we can close the connection once the updates are installed
 	// (THIS SHOULD HAPPEN OVER WIFI INSTEAD!)
-	rpc_router := GetSetupRPCRouter(conn, wifi_manager, srv, pairing_ui)
+	rpc_router := GetSetupRPCRouter(conn, wifi_manager, connectivity, apManager, srv, pairing_ui)
+
+	StartHTTPServer(conn, wifi_manager, connectivity, apManager, srv, pairing_ui)
 
-	StartHTTPServer(conn, wifi_manager, srv, pairing_ui)
+	// for users without the app, a wizard using the same api is served to clients of the setup network
+	StartWebWizard()
 
 	auth_handler := new(OneTimeAuthHandler)
 	auth_handler.Init("spheramid")
@@ -148,7 +209,14 @@ func main() {
 	//log.Println("Starting setup assistant...");
 	//log.Fatal(srv.AdvertiseAndServe())
 
-	states := wifi_manager.WatchState()
+	states := wifi_manager.SubscribeState(SubscribeOptions{Buffer: 128, Policy: DropOldest})
+	defer states.Unsubscribe()
+
+	uplinks := connectivity.SubscribeUplink(SubscribeOptions{Buffer: 16, Policy: DropOldest, NoReplay: true})
+	defer uplinks.Unsubscribe()
+
+	stations := apManager.SubscribeStations(SubscribeOptions{Buffer: 16, Policy: DropOldest})
+	defer stations.Unsubscribe()
 
 	//wifi_manager.WifiConfigured()
 
@@ -156,17 +224,20 @@ func main() {
 
 	is_serving_pairer := false
 
-	// start by forcing the state to Disconnected.
-	// reloading the configuration in wpa_supplicant will also force this,
-	// but we need to do it here in case we are already disconnected
-	states <- WifiStateDisconnected
-	wifi_manager.Controller.ReloadConfiguration()
+	// the subscription starts with the current state, which is Disconnected until wpa_supplicant
+	// reports otherwise. reloading the configuration in wpa_supplicant will also force this.
+	wifi_manager.Backend.ReloadConfiguration()
 
 	badWifiMessage := false
 
 	handleBadWireless := func() {
 		logger.Warningf("Wireless is stale! Invalid SSID, router down, or not in range.")
 
+		if uplink := connectivity.Uplink(); uplink.Uplink != UplinkNone {
+			logger.Infof("Online through %s (%s), not starting pairing.", uplink.Uplink, uplink.Interface)
+			return
+		}
+
 		if !is_serving_pairer {
 			is_serving_pairer = true
 			colorHintSent = false
@@ -198,7 +269,38 @@ func main() {
 			// and if the hostap isn't normally active, make it active
 			if !config.Wireless_Host.Always_Active {
 				logger.Infof("Launching AdHoc pairing assistant...")
-				apManager.StartHostAP()
+				if err := apManager.StartHostAP(); err != nil {
+					logger.Errorf("%v", err)
+				}
+			}
+		}
+	}
+
+	stopPairing := func() {
+		if badWifiMessage {
+			badWifiMessage = false
+			pairing_ui.EnableControl()
+		}
+
+		if is_serving_pairer {
+			is_serving_pairer = false
+
+			// Sleep for 10s before killing ble, just in case we're using it
+			go func() {
+				time.Sleep(time.Second * 10)
+				srv.Close()
+			}()
+
+			// and if the hostap isn't normally active, turn it off again
+			if !config.Wireless_Host.Always_Active {
+				logger.Infof("Terminating AdHoc pairing assistant.")
+				go func() {
+					// Sleep for 20 sec before killing ap, just in case we're using it to set up!
+					time.Sleep(time.Second * 20)
+					if err := apManager.StopHostAP(); err != nil {
+						logger.Errorf("%v", err)
+					}
+				}()
 			}
 		}
 	}
@@ -215,46 +317,95 @@ func main() {
 	}
 
 	for {
-		state := <-states
-		logger.Infof("State: %v", state)
+		var state string
+
+		select {
+		case state = <-states.C:
+			logger.Infof("State: %v", state)
+
+		case uplink := <-uplinks.C:
+			logger.Infof("Uplink: %v", uplink)
+
+			switch uplink {
+			case UplinkEthernet:
+				// wired is good enough, whatever wlan0 is doing
+				stopPairing()
+
+			case UplinkNone:
+				// restart the staleness timer, pairing may have been skipped while we had another uplink
+				if wireless_stale != nil {
+					wireless_stale.Stop()
+				}
+				wireless_stale = time.AfterFunc(WirelessStaleTimeout, handleBadWireless)
+			}
+			continue
+
+		case s := <-stations.C:
+			event, err := ParseAPEvent(s)
+			if err != nil {
+				continue
+			}
+
+			// only while pairing, a demo AP shouldn't take over the display
+			if is_serving_pairer && !config.Wireless_Host.Always_Active {
+				if event.Event == APStationConnected {
+					pairing_ui.DisplayIcon("ble-connected.gif")
+				} else if apManager.StationCount() == 0 {
+					pairing_ui.DisplayIcon("phone-fade.gif")
+				}
+			}
+			continue
+
+		case <-apIdle:
+			// nobody came, so give up on this round of pairing. the next time the wireless goes
+			// stale starts it again, access point and all.
+			if is_serving_pairer {
+				logger.Infof("Stopping the BLE pairing assistant along with the idle access point.")
+				is_serving_pairer = false
+				srv.Close()
+				if badWifiMessage {
+					badWifiMessage = false
+					pairing_ui.EnableControl()
+				}
+			}
+			if wireless_stale != nil {
+				wireless_stale.Stop()
+			}
+			wireless_stale = nil
+			continue
+
+		case <-wpsRequests:
+			logger.Infof("WPS requested by the reset button")
+			go func() {
+				pairing_ui.DisplayIcon("wifi-searching.gif")
+				result := wifi_manager.ConnectWPS()
+				logger.Infof("WPS result: %v", result)
+				pairing_ui.DisplayIcon(result.Icon())
+			}()
+			continue
+		}
 
 		switch state {
-		case WifiStateConnected:
+		case WifiStateConnected, WifiStateHasIP:
+			// associated, but not yet online. if we never get there, treat the wireless as stale.
+			logger.Infof("Connected, waiting for IP and internet access.")
+			if wireless_stale == nil {
+				wireless_stale = time.AfterFunc(WirelessStaleTimeout, handleBadWireless)
+			}
+
+		case WifiStateOnline:
 			if wireless_stale != nil {
 				wireless_stale.Stop()
 			}
 			wireless_stale = nil
-			logger.Infof("Connected and attempting to get IP.")
+			logger.Infof("Online.")
 
 			/*if !config.Wireless_Host.Enables_Control {
 				// if the wireless AP mode hasn't already enabled normal control, then enable it now that wifi works
 				controlChecker.StartHeartbeat()
 			}*/
 
-			if badWifiMessage {
-				badWifiMessage = false
-				pairing_ui.EnableControl()
-			}
-
-			if is_serving_pairer {
-				is_serving_pairer = false
-
-				// Sleep for 10s before killing ble, just in case we're using it
-				go func() {
-					time.Sleep(time.Second * 10)
-					srv.Close()
-				}()
-
-				// and if the hostap isn't normally active, turn it off again
-				if !config.Wireless_Host.Always_Active {
-					logger.Infof("Terminating AdHoc pairing assistant.")
-					go func() {
-						// Sleep for 20 sec before killing ap, just in case we're using it to set up!
-						time.Sleep(time.Second * 20)
-						apManager.StopHostAP()
-					}()
-				}
-			}
+			stopPairing()
 
 			if factoryReset {
 				// if the app provided credentials, then we need to wait for app to acknowledge the connected state
@@ -266,7 +417,7 @@ func main() {
 				})
 			}
 
-		case WifiStateDisconnected:
+		case WifiStateDisconnected, WifiStateAuthFailed, WifiStateRejected, WifiStateNotFound:
 			if wireless_stale == nil {
 				wireless_stale = time.AfterFunc(WirelessStaleTimeout, handleBadWireless)
 			}
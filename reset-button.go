@@ -18,6 +18,8 @@ import (
 
 // In the select state, the LED cycles between the following modes:
 
+// - wps (blue)
+// - show-key (purple)
 // - halt (grey)
 // - reboot (green)
 // - reset-userdata (yellow)
@@ -30,7 +32,8 @@ import (
 // In the grace state, the color fades. During this time, if the user
 // presses the button again, the device moves into the abort state. Otherwise,
 // the device proceeds to the commit state and the action selected action
-// is taken.
+// is taken. wps and show-key are handled by the setup assistant itself (starting WPS push button configuration
+// and showing the access point key), after which the device returns to the rest state.
 
 // In the abort state, the color fades from white to black and then the device returns to the rest state.
 
@@ -41,16 +44,34 @@ const (
 	safeGraceDelay      = time.Second * time.Duration(5)
 	abortDelay          = time.Second * time.Duration(1)
 	factoryResetMagic   = 168
+	// the reset modes are drawn by the led controller, which doesn't know about wps or show-key, so we show their colours ourselves
+	WPSModeColor     = "#0050FF"
+	ShowKeyModeColor = "#A000FF"
 )
 
 // the modes that we cycle between when we are in the 'select' state.
 
-// the modes form a pendulum that swings from halt -> reboot -> reset-userdata ->reset-root -> abort and back again.
+// the modes form a pendulum that swings from wps -> show-key -> halt -> reboot -> reset-userdata ->reset-root -> abort and back again.
 
 var (
-	modeCycle = []string{"halt", "reboot", "reset-userdata", "reset-root", "abort", "reset-root", "reset-userdata", "reboot", "halt", "abort"}
+	modeCycle = []string{"wps", "show-key", "halt", "reboot", "reset-userdata", "reset-root", "abort", "reset-root", "reset-userdata", "reboot", "halt", "show-key", "wps", "abort"}
 )
 
+// the services stopped before each reset. the ones that write to /data are stopped so that they
+// don't write to it while (or after) it is wiped, and the factory reset takes over from the led
+// controller too. reset-helper.sh stops them again for a factory reset, as it is also run
+// directly.
+var resetStoppedServices = map[string][]string{
+	"reset-userdata": {"sphere-client", "sphere-director"},
+	"reset-root":     {"sphere-client", "sphere-director", "ledcontroller"},
+}
+
+// the colours of the modes that the led controller doesn't know about
+var modeColors = map[string]string{
+	"wps":      WPSModeColor,
+	"show-key": ShowKeyModeColor,
+}
+
 // a resetButton is a state machine that listens to the reset button
 type resetButton struct {
 	current   state                    // the current state of the reset button controller
@@ -58,6 +79,8 @@ type resetButton struct {
 	callback  func(m *model.ResetMode) // the callback used to display the state of the controller to the user
 	timeout   *time.Timer              // the timer for the current state
 	ticks     *time.Timer              // the tick timer - we sample hardware button on these ticks
+	actions   map[string]func()        // the modes that are committed by calling a function, rather than reset-helper.sh
+	services  ServiceManager           // stops resetStoppedServices before a reset
 }
 
 // a state of the resetButton state machine
@@ -69,13 +92,15 @@ type state interface {
 }
 
 // start a new reset button monitor
-func startResetMonitor(callback func(m *model.ResetMode)) {
+func startResetMonitor(callback func(m *model.ResetMode), actions map[string]func(), services ServiceManager) {
 	r := &resetButton{
 		current:   &stateRest{},
 		modeIndex: 0,
 		callback:  callback,
 		timeout:   time.NewTimer(0),
 		ticks:     time.NewTimer(shortDelay),
+		actions:   actions,
+		services:  services,
 	}
 	r.timeout.Stop()
 	select {
@@ -147,6 +172,17 @@ func (r *resetButton) String() string {
 
 // commit the currently selected mode
 func (r *resetButton) commit() {
+	if action, ok := r.actions[modeCycle[r.modeIndex]]; ok {
+		// nothing for reset-helper.sh to do
+		action()
+		return
+	}
+	for _, name := range resetStoppedServices[modeCycle[r.modeIndex]] {
+		if err := r.services.Stop(name); err != nil {
+			// reset anyway, the reset matters more than what these might write
+			logger.Warningf("failed to stop %s before %s: %v", name, modeCycle[r.modeIndex], err)
+		}
+	}
 	if path, err := exec.LookPath("reset-helper.sh"); err != nil {
 		logger.Warningf("could not find reset-helper.sh: %v", err)
 	} else {
@@ -311,4 +347,12 @@ type stateCommit struct {
 
 func (s *stateCommit) onEnter(r *resetButton) {
 	r.commit()
+	if _, ok := r.actions[modeCycle[r.modeIndex]]; ok {
+		// the sphere carries on as normal, so go back to waiting for the button
+		r.timeout.Reset(shortDelay)
+	}
+}
+
+func (s *stateCommit) onTimeout(r *resetButton) state {
+	return &stateRest{}
 }
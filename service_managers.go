@@ -0,0 +1,168 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+)
+
+// upstartManager drives upstart jobs with start, stop and status. Services that aren't upstart
+// jobs (dnsmasq is still a sysvinit script) are driven with service.
+type upstartManager struct{}
+
+// isJob returns true if the service is an upstart job rather than a sysvinit script
+func (m *upstartManager) isJob(name string) bool {
+	_, err := os.Stat("/etc/init/" + name + ".conf")
+	return err == nil
+}
+
+func (m *upstartManager) Name() string {
+	return "upstart"
+}
+
+// Status parses the goal/state that `status` reports, e.g. "hostapd-ap0 start/running, process 1234"
+// or "hostapd-ap0 stop/waiting"
+func (m *upstartManager) Status(name string) (string, error) {
+	if !m.isJob(name) {
+		return sysvStatus(name)
+	}
+
+	out, err := exec.Command("/sbin/status", name).CombinedOutput()
+	if err != nil {
+		// e.g. "status: Unknown job: hostapd-ap0"
+		return "", fmt.Errorf("status %s: %v: %s", name, err, strings.TrimSpace(string(out)))
+	}
+	return parseUpstartStatus(name, string(out))
+}
+
+func parseUpstartStatus(name string, out string) (string, error) {
+	fields := strings.Fields(out)
+	if len(fields) < 2 || fields[0] != name {
+		return "", fmt.Errorf("unexpected status of %s: %s", name, strings.TrimSpace(out))
+	}
+	parts := strings.SplitN(strings.TrimRight(fields[1], ","), "/", 2)
+	if len(parts) != 2 {
+		return "", fmt.Errorf("unexpected status of %s: %s", name, strings.TrimSpace(out))
+	}
+	goal, state := parts[0], parts[1]
+
+	switch {
+	case goal == "start" && state == "running":
+		return ServiceRunning, nil
+	case goal == "stop" && state == "waiting":
+		return ServiceStopped, nil
+	case goal == "start":
+		return ServiceStarting, nil
+	default:
+		return ServiceStopping, nil
+	}
+}
+
+// the state a job is in on its way to each state
+var serviceHeadingTo = map[string]string{
+	ServiceRunning: ServiceStarting,
+	ServiceStopped: ServiceStopping,
+}
+
+// control runs start or stop, which fail if the job is already where we want it, so a failure
+// only counts if the job isn't there or on its way
+func (m *upstartManager) control(command string, name string, want string) error {
+	if !m.isJob(name) {
+		if out, err := exec.Command("/usr/sbin/service", name, command).CombinedOutput(); err != nil {
+			return fmt.Errorf("service %s %s: %v: %s", name, command, err, strings.TrimSpace(string(out)))
+		}
+		return waitForServiceState(m, name, want, ServiceStateTimeout)
+	}
+
+	out, err := exec.Command("/sbin/"+command, name).CombinedOutput()
+	if err != nil {
+		// a real failure, e.g. an unknown job, would otherwise only show up as a timeout. the job
+		// may also be on its way there already.
+		state, statusErr := m.Status(name)
+		if statusErr != nil || (state != want && state != serviceHeadingTo[want]) {
+			return fmt.Errorf("%s %s: %v: %s", command, name, err, strings.TrimSpace(string(out)))
+		}
+		logger.Debugf("%s %s: %v: %s", command, name, err, strings.TrimSpace(string(out)))
+	}
+	return waitForServiceState(m, name, want, ServiceStateTimeout)
+}
+
+func (m *upstartManager) Start(name string) error {
+	return m.control("start", name, ServiceRunning)
+}
+
+func (m *upstartManager) Stop(name string) error {
+	return m.control("stop", name, ServiceStopped)
+}
+
+func (m *upstartManager) Restart(name string) error {
+	// upstart's restart fails on a stopped job, and doesn't re-run pre-start
+	if err := m.Stop(name); err != nil {
+		return err
+	}
+	return m.Start(name)
+}
+
+// sysvStatus runs an init script's status action, which exits 0 when the service is running and
+// 1 to 3 when it is not (see the LSB init script actions)
+func sysvStatus(name string) (string, error) {
+	out, err := exec.Command("/usr/sbin/service", name, "status").CombinedOutput()
+	if err == nil {
+		return ServiceRunning, nil
+	}
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.ExitStatus() >= 1 && status.ExitStatus() <= 3 {
+			return ServiceStopped, nil
+		}
+	}
+	return "", fmt.Errorf("service %s status: %v: %s", name, err, strings.TrimSpace(string(out)))
+}
+
+// systemdManager drives systemd units with systemctl
+type systemdManager struct{}
+
+func (m *systemdManager) Name() string {
+	return "systemd"
+}
+
+// Status maps the output of `systemctl is-active`, which exits non-zero for anything but active
+func (m *systemdManager) Status(name string) (string, error) {
+	out, err := exec.Command("systemctl", "is-active", name).Output()
+	state := strings.TrimSpace(string(out))
+
+	switch state {
+	case "active", "reloading":
+		return ServiceRunning, nil
+	case "inactive", "failed":
+		return ServiceStopped, nil
+	case "activating":
+		return ServiceStarting, nil
+	case "deactivating":
+		return ServiceStopping, nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("systemctl is-active %s: %v: %s", name, err, state)
+	}
+	return "", fmt.Errorf("unexpected state of %s: %s", name, state)
+}
+
+func (m *systemdManager) control(command string, name string, want string) error {
+	if out, err := exec.Command("systemctl", command, name).CombinedOutput(); err != nil {
+		return fmt.Errorf("systemctl %s %s: %v: %s", command, name, err, strings.TrimSpace(string(out)))
+	}
+	return waitForServiceState(m, name, want, ServiceStateTimeout)
+}
+
+func (m *systemdManager) Start(name string) error {
+	return m.control("start", name, ServiceRunning)
+}
+
+func (m *systemdManager) Stop(name string) error {
+	return m.control("stop", name, ServiceStopped)
+}
+
+func (m *systemdManager) Restart(name string) error {
+	return m.control("restart", name, ServiceRunning)
+}
@@ -0,0 +1,126 @@
+package main
+
+import "sync"
+
+// DeliveryPolicy decides what happens to a state change when a subscriber's buffer is full.
+// States are never delivered by blocking, so a slow subscriber can't stall the event loop.
+type DeliveryPolicy int
+
+const (
+	DropNewest DeliveryPolicy = iota // discard the new state, keeping what is already queued
+	DropOldest                       // discard the oldest queued state to make room for the new one
+	Coalesce                         // only ever hold the most recent state
+)
+
+type SubscribeOptions struct {
+	Buffer   int            // size of the subscription channel, ignored when coalescing
+	Policy   DeliveryPolicy // what to do when the channel is full
+	NoReplay bool           // don't deliver the last state seen on subscription
+}
+
+// StateSubscription is a handle to a stream of states. Call Unsubscribe once done with it.
+type StateSubscription struct {
+	C <-chan string
+
+	ch          chan string
+	policy      DeliveryPolicy
+	dropped     int
+	broadcaster *stateBroadcaster
+}
+
+// Unsubscribe stops delivery to the subscription. It is safe to call more than once.
+func (s *StateSubscription) Unsubscribe() {
+	s.broadcaster.unsubscribe(s)
+}
+
+// Dropped returns the number of states that were discarded because the subscriber fell behind
+func (s *StateSubscription) Dropped() int {
+	s.broadcaster.Lock()
+	defer s.broadcaster.Unlock()
+	return s.dropped
+}
+
+// deliver hands the state to the subscriber without blocking. Must be called with the broadcaster locked.
+func (s *StateSubscription) deliver(state string) {
+	select {
+	case s.ch <- state:
+		return
+	default:
+	}
+
+	s.dropped++
+	if s.policy == DropNewest {
+		return
+	}
+
+	// only the broadcaster sends, and it holds the lock, so once we've made room the send can't block
+	select {
+	case <-s.ch:
+	default:
+	}
+	select {
+	case s.ch <- state:
+	default:
+	}
+}
+
+// stateBroadcaster fans states out to subscribers, remembering the last one
+type stateBroadcaster struct {
+	sync.Mutex
+	subscribers map[*StateSubscription]bool
+	last        string
+}
+
+func newStateBroadcaster(initial string) *stateBroadcaster {
+	return &stateBroadcaster{
+		subscribers: make(map[*StateSubscription]bool),
+		last:        initial,
+	}
+}
+
+func (b *stateBroadcaster) Subscribe(opts SubscribeOptions) *StateSubscription {
+	size := opts.Buffer
+	if opts.Policy == Coalesce || size < 1 {
+		size = 1
+	}
+
+	ch := make(chan string, size)
+	sub := &StateSubscription{
+		C:           ch,
+		ch:          ch,
+		policy:      opts.Policy,
+		broadcaster: b,
+	}
+
+	b.Lock()
+	defer b.Unlock()
+
+	b.subscribers[sub] = true
+	if !opts.NoReplay && b.last != "" {
+		sub.deliver(b.last)
+	}
+
+	return sub
+}
+
+func (b *stateBroadcaster) unsubscribe(sub *StateSubscription) {
+	b.Lock()
+	defer b.Unlock()
+	delete(b.subscribers, sub)
+}
+
+func (b *stateBroadcaster) Emit(state string) {
+	b.Lock()
+	defer b.Unlock()
+
+	b.last = state
+	for sub := range b.subscribers {
+		sub.deliver(state)
+	}
+}
+
+func (b *stateBroadcaster) Last() string {
+	b.Lock()
+	defer b.Unlock()
+	return b.last
+}
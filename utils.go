@@ -23,14 +23,15 @@ func WriteToFile(filename string, contents string) error {
 	return nil
 }
 
-func GetWlanAddress() (string, error) {
+// GetInterfaceAddress returns the first ipv4 address of the named interface
+func GetInterfaceAddress(name string) (string, error) {
 	ifaces, err := net.Interfaces()
 	if err != nil {
 		return "", err
 	}
 
 	for _, iface := range ifaces {
-		if iface.Name != "wlan0" {
+		if iface.Name != name {
 			continue
 		}
 		if iface.Flags&net.FlagUp == 0 {
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// the address of ap0, which dnsmasq hands out as the answer to every dns query on the setup network
+const APAddress = "172.16.0.1"
+
+// how often to try serving the setup wizard again, e.g. while ap0 has no address
+const WebWizardRetryInterval = time.Second * 10
+
+// the urls that phones and laptops fetch to decide whether a network has a captive portal. anything
+// other than the expected answer makes them show the portal.
+var captivePortalProbes = []string{
+	"/generate_204",        // android, chrome
+	"/gen_204",             // android
+	"/hotspot-detect.html", // apple
+	"/library/test/success.html",
+	"/ncsi.txt",        // windows
+	"/connecttest.txt", // windows 10
+	"/success.txt",     // firefox
+}
+
+// StartWebWizard serves the setup wizard on port 80, for users without the app. The wizard is
+// driven by the same http api as the app (under /api/), and every other host and path redirects
+// to it, so that joining the setup network pops up the wizard.
+func StartWebWizard() {
+	mux := http.NewServeMux()
+
+	mux.Handle("/api/", http.StripPrefix("/api", http.DefaultServeMux))
+
+	for _, probe := range captivePortalProbes {
+		mux.HandleFunc(probe, redirectToWizard)
+	}
+
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if i := strings.Index(host, ":"); i >= 0 {
+			host = host[:i]
+		}
+		if host != APAddress || r.URL.Path != "/" {
+			redirectToWizard(w, r)
+			return
+		}
+
+		logger.Infof("Serving the setup wizard to %s", r.RemoteAddr)
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Header().Set("Cache-Control", "no-cache, no-store")
+		io.WriteString(w, webWizardPage)
+	})
+
+	go func() {
+		// only on ap0, /api/ is the whole setup api and must not be reachable from wlan0 or the lan
+		addr := APAddress + ":80"
+		lastErr := ""
+		for {
+			logger.Infof("Starting setup wizard on %s", addr)
+			err := http.ListenAndServe(addr, mux)
+			// not fatal, the app can still use the api on 8888. ap0 doesn't have its address until
+			// hostapd's job has brought it up, so keep trying.
+			if err.Error() != lastErr {
+				logger.Errorf("Setup wizard failed: %s", err)
+				lastErr = err.Error()
+			}
+			time.Sleep(WebWizardRetryInterval)
+		}
+	}()
+}
+
+func redirectToWizard(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-cache, no-store")
+	http.Redirect(w, r, "http://"+APAddress+"/", http.StatusFound)
+}
+
+const webWizardPage = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>Ninja Sphere Setup</title>
+<style>
+body { font-family: sans-serif; margin: 0; padding: 1em; background: #f4f4f4; color: #222; }
+h1 { font-size: 1.4em; }
+.panel { background: #fff; border-radius: 4px; padding: 1em; margin-bottom: 1em; }
+.hidden { display: none; }
+ul { list-style: none; padding: 0; margin: 0; }
+li { padding: 0.8em 0.5em; border-bottom: 1px solid #eee; cursor: pointer; }
+li .detail { float: right; color: #888; font-size: 0.9em; }
+input, select, button { font-size: 1em; padding: 0.5em; width: 100%; box-sizing: border-box; margin: 0.3em 0; }
+button { background: #2a8; color: #fff; border: 0; border-radius: 4px; }
+.error { color: #c33; }
+</style>
+</head>
+<body>
+<h1>Ninja Sphere Setup</h1>
+
+<div id="networks" class="panel">
+	<p>Choose the WiFi network the sphere should use.</p>
+	<ul id="network-list"><li>Searching&hellip;</li></ul>
+	<button id="rescan">Search again</button>
+	<button id="other">Other network&hellip;</button>
+</div>
+
+<div id="credentials" class="panel hidden">
+	<form id="credentials-form">
+		<label>Network name <input id="ssid" autocomplete="off" autocapitalize="off"></label>
+		<label>Security
+			<select id="security">
+				<option value="">Automatic</option>
+				<option value="open">None</option>
+				<option value="wep">WEP</option>
+				<option value="wpa-psk">WPA/WPA2</option>
+				<option value="wpa2-wpa3">WPA2/WPA3</option>
+				<option value="wpa3-sae">WPA3</option>
+			</select>
+		</label>
+		<label>Password <input id="key" type="password" autocomplete="off"></label>
+		<button type="submit">Connect</button>
+		<button type="button" id="back">Back</button>
+	</form>
+</div>
+
+<div id="progress" class="panel hidden">
+	<p>Connecting to <b id="progress-ssid"></b>&hellip; this can take up to a minute.</p>
+</div>
+
+<div id="result" class="panel hidden">
+	<p id="result-message"></p>
+	<button id="retry" class="hidden">Try again</button>
+</div>
+
+<script>
+function show(id) {
+	["networks", "credentials", "progress", "result"].forEach(function(panel) {
+		document.getElementById(panel).className = panel == id ? "panel" : "panel hidden";
+	});
+}
+
+function request(method, url, body, done) {
+	var xhr = new XMLHttpRequest();
+	xhr.open(method, url);
+	xhr.onreadystatechange = function() {
+		if (xhr.readyState == 4) {
+			done(xhr.status, xhr.responseText);
+		}
+	};
+	xhr.send(body);
+}
+
+function choose(ssid, security) {
+	document.getElementById("ssid").value = ssid;
+	document.getElementById("security").value = security || "";
+	document.getElementById("key").value = "";
+	show("credentials");
+}
+
+function scan() {
+	var list = document.getElementById("network-list");
+	list.innerHTML = "<li>Searching&hellip;</li>";
+	request("GET", "/api/get_visible_wifi_networks", null, function(status, text) {
+		list.innerHTML = "";
+		if (status != 200) {
+			list.innerHTML = "<li class=\"error\">Could not search for networks</li>";
+			return;
+		}
+		JSON.parse(text).forEach(function(network) {
+			var item = document.createElement("li");
+			var detail = document.createElement("span");
+			detail.className = "detail";
+			detail.textContent = network.quality + "%" + (network.secured ? ", secured" : "");
+			item.appendChild(detail);
+			item.appendChild(document.createTextNode(network.name));
+			item.onclick = function() { choose(network.name, network.security); };
+			list.appendChild(item);
+		});
+	});
+}
+
+document.getElementById("rescan").onclick = scan;
+document.getElementById("other").onclick = function() { choose("", ""); };
+document.getElementById("back").onclick = function() { show("networks"); };
+document.getElementById("retry").onclick = function() { show("credentials"); };
+
+document.getElementById("credentials-form").onsubmit = function(e) {
+	e.preventDefault();
+	var creds = {
+		ssid: document.getElementById("ssid").value,
+		key: document.getElementById("key").value,
+		security: document.getElementById("security").value
+	};
+	document.getElementById("progress-ssid").textContent = creds.ssid;
+	show("progress");
+
+	request("POST", "/api/connect_wifi_network", JSON.stringify(creds), function(status, text) {
+		var message = document.getElementById("result-message");
+		var retry = document.getElementById("retry");
+		if (status == 200) {
+			message.className = "";
+			message.textContent = "The sphere is connected to " + creds.ssid + ". This setup network will now close.";
+			retry.className = "hidden";
+		} else {
+			var reason = text;
+			try {
+				reason = JSON.parse(text).message;
+			} catch (err) {
+			}
+			message.className = "error";
+			message.textContent = reason;
+			retry.className = "";
+		}
+		show("result");
+	});
+};
+
+scan();
+</script>
+</body>
+</html>
+`
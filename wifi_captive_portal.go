@@ -0,0 +1,108 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// how a network treats our http probe
+const (
+	PortalOpen    = "open"    // the probe got the expected response
+	PortalCaptive = "captive" // the probe was redirected, or the response was altered (a login page)
+	PortalBlocked = "blocked" // the probe didn't get a response at all
+)
+
+// PortalResult is the classification of the network, reported by connect_wifi_network and /status
+type PortalResult struct {
+	Status   string `json:"status"`             // one of the Portal* constants
+	Location string `json:"location,omitempty"` // where a captive portal redirected us to
+}
+
+// PortalProbe fetches a url with a well known response, to find out whether a network is hiding
+// the internet behind a login page
+type PortalProbe struct {
+	URL     string
+	Status  int    // the expected status code
+	Content string // the expected body, if set
+	Timeout time.Duration
+}
+
+func NewPortalProbe(config AssistantConfig) PortalProbe {
+	return PortalProbe{
+		URL:     config.Connectivity.Portal_URL,
+		Status:  config.Connectivity.Portal_Status,
+		Content: config.Connectivity.Portal_Content,
+		Timeout: time.Duration(config.Connectivity.Probe_Timeout) * time.Second,
+	}
+}
+
+// Classify fetches the probe url, returning nil if the probe is disabled
+func (p PortalProbe) Classify() *PortalResult {
+	if p.URL == "" {
+		return nil
+	}
+
+	client := &http.Client{
+		Timeout: p.Timeout,
+		// a portal redirects to its login page, which is all we need to know
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	resp, err := client.Get(p.URL)
+	if err != nil {
+		logger.Infof("Portal probe to %s failed: %v", p.URL, err)
+		return &PortalResult{Status: PortalBlocked}
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 && resp.StatusCode < 400 {
+		location := resp.Header.Get("Location")
+		logger.Infof("Portal probe to %s was redirected to %s", p.URL, location)
+		return &PortalResult{PortalCaptive, location}
+	}
+
+	if resp.StatusCode != p.Status {
+		logger.Infof("Portal probe to %s returned %d, expected %d", p.URL, resp.StatusCode, p.Status)
+		return &PortalResult{Status: PortalCaptive}
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return &PortalResult{Status: PortalBlocked}
+	}
+	if p.Content != "" && strings.TrimSpace(string(body)) != p.Content {
+		logger.Infof("Portal probe to %s returned unexpected content", p.URL)
+		return &PortalResult{Status: PortalCaptive}
+	}
+	if p.Status == http.StatusNoContent && len(body) > 0 {
+		// a portal serving its login page with the status we expected
+		logger.Infof("Portal probe to %s returned content with a %d", p.URL, resp.StatusCode)
+		return &PortalResult{Status: PortalCaptive}
+	}
+
+	return &PortalResult{Status: PortalOpen}
+}
+
+// Portal returns the last classification of the network wlan0 is connected to, or nil if it
+// hasn't been probed
+func (m *WifiManager) Portal() *PortalResult {
+	m.connLock.Lock()
+	defer m.connLock.Unlock()
+	return m.portal
+}
+
+// checkPortal probes the network and remembers the result
+func (m *WifiManager) checkPortal() *PortalResult {
+	portal := m.portalProbe.Classify()
+
+	m.connLock.Lock()
+	defer m.connLock.Unlock()
+	if m.associated {
+		m.portal = portal
+	}
+	return portal
+}
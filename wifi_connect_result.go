@@ -0,0 +1,217 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const (
+	// how long to wait for wpa_supplicant to associate with a new network
+	WifiConnectTimeout = time.Second * 30
+	// how long to wait for an address once associated
+	WifiDHCPTimeout = time.Second * 20
+	// wpa_supplicant reports the network missing after every scan, so give it a few scans before giving up
+	notFoundScanLimit = 3
+	// how much longer than ConnectTimeout the rpc and http apis wait for SetCredentials, for the
+	// wpa_supplicant calls around the attempt and the rollback
+	ConnectResponseGrace = time.Second * 10
+)
+
+// reasons that a connection attempt can fail
+const (
+	ConnectReasonWrongKey      = "wrong_key"
+	ConnectReasonNotFound      = "ssid_not_found"
+	ConnectReasonRejected      = "association_rejected"
+	ConnectReasonAuthTimeout   = "auth_timeout"
+	ConnectReasonDHCPFailed    = "dhcp_failed"
+	ConnectReasonNoInternet    = "no_internet"
+	ConnectReasonInvalidConfig = "invalid_config"
+	ConnectReasonWPSFailed     = "wps_failed"
+	ConnectReasonWPSTimeout    = "wps_timeout"
+	ConnectReasonWPSOverlap    = "wps_overlap"
+	ConnectReasonCaptivePortal = "captive_portal"
+	ConnectReasonTimeout       = "timeout" // no result at all in time
+)
+
+type connectFailure struct {
+	code       int
+	message    string
+	httpStatus int
+}
+
+var connectFailures = map[string]connectFailure{
+	ConnectReasonWrongKey:      {-32001, "Could not connect to specified WiFi network, is the key correct?", http.StatusBadRequest},
+	ConnectReasonNotFound:      {-32002, "Could not find the specified WiFi network, is it in range?", http.StatusNotFound},
+	ConnectReasonRejected:      {-32003, "The WiFi network rejected the connection", http.StatusForbidden},
+	ConnectReasonAuthTimeout:   {-32004, "Timed out authenticating with the WiFi network", http.StatusGatewayTimeout},
+	ConnectReasonDHCPFailed:    {-32005, "Connected to the WiFi network but did not get an IP address", http.StatusBadGateway},
+	ConnectReasonNoInternet:    {-32006, "Connected to the WiFi network but could not reach the internet", http.StatusBadGateway},
+	ConnectReasonInvalidConfig: {-32007, "The WiFi network settings are invalid", http.StatusBadRequest},
+	ConnectReasonWPSFailed:     {-32008, "WPS push button configuration failed", http.StatusBadGateway},
+	ConnectReasonWPSTimeout:    {-32009, "No router started WPS push button configuration in time", http.StatusGatewayTimeout},
+	ConnectReasonWPSOverlap:    {-32010, "More than one router is doing WPS push button configuration", http.StatusConflict},
+	ConnectReasonCaptivePortal: {-32011, "The WiFi network requires a login in a browser", http.StatusNetworkAuthenticationRequired},
+	ConnectReasonTimeout:       {-32012, "Timed out connecting to the WiFi network", http.StatusGatewayTimeout},
+}
+
+// ConnectResult describes the outcome of SetCredentials
+type ConnectResult struct {
+	Success bool   `json:"success"`
+	SSID    string `json:"ssid"`
+	Reason  string `json:"reason,omitempty"`
+	Detail  string `json:"detail,omitempty"`
+	IP      string `json:"ip,omitempty"`
+
+	// the captive portal check, once we have an address
+	Portal *PortalResult `json:"portal,omitempty"`
+
+	// an 802.1X network that was added without validating its server, at the app's request
+	Insecure bool `json:"insecure,omitempty"`
+
+	// on success, the sphere's serial number for the app to pair with
+	Serial string `json:"serial,omitempty"`
+
+	// on failure, whether the networks that were enabled before the change were restored
+	Restored     bool   `json:"restored"`
+	RestoredSSID string `json:"restoredSsid,omitempty"`
+}
+
+func connectFailed(ssid string, reason string, detail string) *ConnectResult {
+	return &ConnectResult{
+		SSID:   ssid,
+		Reason: reason,
+		Detail: detail,
+	}
+}
+
+func (r *ConnectResult) String() string {
+	if r.Success {
+		return fmt.Sprintf("connected to %s with ip %s", r.SSID, r.IP)
+	}
+	if r.Restored {
+		return fmt.Sprintf("failed to connect to %s: %s %s (restored %s)", r.SSID, r.Reason, r.Detail, r.RestoredSSID)
+	}
+	return fmt.Sprintf("failed to connect to %s: %s %s", r.SSID, r.Reason, r.Detail)
+}
+
+func (r *ConnectResult) failure() connectFailure {
+	if failure, ok := connectFailures[r.Reason]; ok {
+		return failure
+	}
+	return connectFailure{500, "Could not connect to specified WiFi network", http.StatusInternalServerError}
+}
+
+// Icon is the led icon that should be shown for the result. The led controller only has the one
+// failure icon, the app shows the reason.
+func (r *ConnectResult) Icon() string {
+	if r.Success {
+		return "wifi-connected.gif"
+	}
+	return "wifi-failed.gif"
+}
+
+// RPCError converts a failed result to a JSON-RPC error, with the result itself as the error data
+func (r *ConnectResult) RPCError() *JSONRPCError {
+	failure := r.failure()
+	return &JSONRPCError{failure.code, failure.message, r}
+}
+
+// HTTPStatus is the status code reported by the http api for a failed result
+func (r *ConnectResult) HTTPStatus() int {
+	return r.failure().httpStatus
+}
+
+// connectAttemptTimeout is the longest that waitForConnection waits, however the states come and go
+func (m *WifiManager) connectAttemptTimeout() time.Duration {
+	return WifiConnectTimeout + WifiDHCPTimeout + m.probe.Timeout + AddressPollInterval*2
+}
+
+// ConnectTimeout is the longest SetCredentials waits, for the attempt and for rolling back to the
+// previous network if it fails. The rpc and http apis give it ConnectResponseGrace longer, so
+// that they don't answer while it is still going.
+func (m *WifiManager) ConnectTimeout() time.Duration {
+	// the portal may be checked once each wait is over
+	return 2 * (m.connectAttemptTimeout() + m.portalProbe.Timeout)
+}
+
+// waitForConnection follows the state changes after a new network is selected, until we are online or it has failed
+func (m *WifiManager) waitForConnection(ssid string, states <-chan string) *ConnectResult {
+	timeout := time.After(WifiConnectTimeout)
+	// each state resets the timeout for the next step, so a network that keeps dropping us could
+	// keep us here forever
+	deadline := time.After(m.connectAttemptTimeout())
+	notFound := 0
+	ip := ""
+
+	for {
+		select {
+		case state := <-states:
+			logger.Infof("SetCredentials: Network state: %s", state)
+			switch state {
+			case WifiStateConnected:
+				// associated, now wait for dhcp
+				timeout = time.After(WifiDHCPTimeout)
+			case WifiStateHasIP:
+				// give the reachability probe a chance to complete
+				ip, _ = m.Address()
+				timeout = time.After(m.probe.Timeout + AddressPollInterval*2)
+			case WifiStateOnline:
+				result := &ConnectResult{
+					Success: true,
+					SSID:    ssid,
+					IP:      ip,
+				}
+				m.checkCaptivePortal(result)
+				return result
+			case WifiStateInvalidKey:
+				return connectFailed(ssid, ConnectReasonWrongKey, "")
+			case WifiStateAuthFailed:
+				return connectFailed(ssid, ConnectReasonAuthTimeout, "")
+			case WifiStateRejected:
+				return connectFailed(ssid, ConnectReasonRejected, "")
+			case WifiStateNotFound:
+				notFound++
+				if notFound >= notFoundScanLimit {
+					return connectFailed(ssid, ConnectReasonNotFound, "")
+				}
+			}
+		case <-timeout:
+			return m.connectTimedOut(ssid, ip)
+		case <-deadline:
+			return m.connectTimedOut(ssid, ip)
+		}
+	}
+}
+
+// connectTimedOut works out why waitForConnection didn't get anywhere, given the address we got (if any)
+func (m *WifiManager) connectTimedOut(ssid string, ip string) *ConnectResult {
+	if ip != "" {
+		result := connectFailed(ssid, ConnectReasonNoInternet, fmt.Sprintf("could not reach %s", m.probe.Address))
+		result.IP = ip
+		m.checkCaptivePortal(result)
+		return result
+	}
+	m.connLock.Lock()
+	associated := m.associated
+	m.connLock.Unlock()
+	if associated {
+		return connectFailed(ssid, ConnectReasonDHCPFailed, fmt.Sprintf("no address after %s", WifiDHCPTimeout))
+	}
+	if _, visible := m.LookupSecurity(ssid); visible {
+		return connectFailed(ssid, ConnectReasonAuthTimeout, fmt.Sprintf("not connected after %s", WifiConnectTimeout))
+	}
+	return connectFailed(ssid, ConnectReasonNotFound, "")
+}
+
+// checkCaptivePortal adds the portal check to the result. A network with a captive portal is kept
+// (there's nothing wrong with the credentials), but is reported as a failure so that the app can
+// tell the user that it needs a login.
+func (m *WifiManager) checkCaptivePortal(result *ConnectResult) {
+	result.Portal = m.checkPortal()
+	if result.Portal != nil && result.Portal.Status == PortalCaptive {
+		result.Success = false
+		result.Reason = ConnectReasonCaptivePortal
+		result.Detail = result.Portal.Location
+	}
+}
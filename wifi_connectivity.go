@@ -0,0 +1,139 @@
+package main
+
+import (
+	"net"
+	"time"
+)
+
+// how often we look at the addresses on wlan0
+const AddressPollInterval = time.Second
+
+// ReachabilityProbe decides whether an address on wlan0 actually gets us beyond the router
+type ReachabilityProbe struct {
+	Address  string
+	Interval time.Duration
+	Timeout  time.Duration
+}
+
+func NewReachabilityProbe(config AssistantConfig) ReachabilityProbe {
+	return ReachabilityProbe{
+		Address:  config.Connectivity.Probe_Address,
+		Interval: time.Duration(config.Connectivity.Probe_Interval) * time.Second,
+		Timeout:  time.Duration(config.Connectivity.Probe_Timeout) * time.Second,
+	}
+}
+
+// Reachable opens (and closes) a tcp connection to the probe address
+func (p ReachabilityProbe) Reachable() bool {
+	if p.Address == "" {
+		// probing disabled, an address is as good as it gets
+		return true
+	}
+	conn, err := net.DialTimeout("tcp", p.Address, p.Timeout)
+	if err != nil {
+		logger.Infof("Reachability probe to %s failed: %v", p.Address, err)
+		return false
+	}
+	conn.Close()
+	return true
+}
+
+func (m *WifiManager) setAssociated(associated bool) {
+	m.connLock.Lock()
+	defer m.connLock.Unlock()
+
+	// forget the address, so that the address loop reports has_ip/online afresh for the new association
+	m.associated = associated
+	m.ip = ""
+	m.online = false
+	m.portal = nil
+}
+
+// IsOnline returns true if wlan0 is associated, has an address and the reachability probe succeeds
+func (m *WifiManager) IsOnline() bool {
+	m.connLock.Lock()
+	defer m.connLock.Unlock()
+	return m.online
+}
+
+// addressLoop watches the address on wlan0 while associated, emitting has_ip and online as the
+// address is assigned and the reachability probe succeeds or fails.
+func (m *WifiManager) addressLoop() {
+	var lastProbe time.Time
+
+	for {
+		time.Sleep(AddressPollInterval)
+
+		ip, _ := m.Address()
+
+		m.connLock.Lock()
+		associated := m.associated
+		changed := ip != m.ip
+		if associated {
+			m.ip = ip
+		}
+		online := m.online
+		m.connLock.Unlock()
+
+		if !associated {
+			continue
+		}
+
+		if ip == "" {
+			if changed {
+				logger.Infof("addressLoop: lost address on %s", WirelessNetworkInterface)
+				m.setOnline(false)
+				m.emitState(WifiStateConnected)
+			}
+			continue
+		}
+
+		if changed {
+			logger.Infof("addressLoop: have address %s", ip)
+			online = false
+			m.setOnline(false)
+			m.emitState(WifiStateHasIP)
+			lastProbe = time.Time{}
+		}
+
+		if time.Since(lastProbe) < m.probe.Interval {
+			continue
+		}
+		lastProbe = time.Now()
+
+		reachable := m.probe.Reachable()
+		// the reachability probe often gets through a portal, so it won't notice the user logging
+		// in. Otherwise a portal only lets us through (or stops doing so) when the reachability
+		// changes, so there's no need to fetch the portal probe on every pass.
+		portal := m.Portal()
+		captive := portal != nil && portal.Status == PortalCaptive
+		if reachable == online && !captive {
+			continue
+		}
+
+		m.connLock.Lock()
+		stillCurrent := m.associated && m.ip == ip
+		m.connLock.Unlock()
+		if !stillCurrent {
+			// the association changed while we were probing, the next pass will sort it out
+			continue
+		}
+
+		m.checkPortal()
+		if reachable == online {
+			continue
+		}
+		m.setOnline(reachable)
+		if reachable {
+			m.emitState(WifiStateOnline)
+		} else {
+			m.emitState(WifiStateHasIP)
+		}
+	}
+}
+
+func (m *WifiManager) setOnline(online bool) {
+	m.connLock.Lock()
+	defer m.connLock.Unlock()
+	m.online = online
+}
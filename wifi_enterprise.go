@@ -0,0 +1,148 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// certificates supplied for 802.1X networks are written here, named after the network
+const EnterpriseCertDir = "/data/etc/wifi-certs"
+
+var validEAPMethods = map[string]bool{
+	"PEAP": true,
+	"TTLS": true,
+	"TLS":  true,
+}
+
+// AddEnterpriseNetwork adds and selects a WPA2/WPA3-Enterprise network, storing any
+// supplied certificates under EnterpriseCertDir. It returns the id of the new network.
+func (m *WifiManager) AddEnterpriseNetwork(creds *WifiCredentials) (int, error) {
+	eap := strings.ToUpper(creds.EAP)
+	if !validEAPMethods[eap] {
+		return -1, fmt.Errorf("unsupported EAP method: %s", creds.EAP)
+	}
+
+	if eap == "TLS" && (creds.ClientCert == "" || creds.PrivateKey == "") {
+		return -1, fmt.Errorf("EAP-TLS requires a client certificate and private key")
+	}
+
+	if !creds.ValidatesServer() {
+		if !creds.NoServerValidation {
+			// anyone can set up an access point with the same ssid and collect the credentials
+			return -1, fmt.Errorf("a CA certificate or domain suffix is required to validate the server")
+		}
+		logger.Warningf("AddEnterpriseNetwork: Not validating the server of %s, as requested", creds.SSID)
+	}
+
+	certs, err := writeEnterpriseCerts(creds)
+	if err != nil {
+		return -1, err
+	}
+
+	i, err := m.Backend.AddNetwork()
+	if err != nil {
+		return -1, err
+	}
+	// wpa_supplicant rejects values it doesn't understand (an unknown phase2, say), which would
+	// otherwise only show up as a connection that never happens
+	var setErr error
+	set := func(name string, value string) {
+		if setErr == nil {
+			if err := m.Backend.SetNetworkSettingString(i, name, value); err != nil {
+				setErr = fmt.Errorf("invalid %s: %v", name, err)
+			}
+		}
+	}
+	setRaw := func(name string, value string) {
+		if setErr == nil {
+			if err := m.Backend.SetNetworkSettingRaw(i, name, value); err != nil {
+				setErr = fmt.Errorf("invalid %s: %v", name, err)
+			}
+		}
+	}
+
+	set("ssid", creds.SSID)
+	setRaw("scan_ssid", "1")
+	setRaw("key_mgmt", "WPA-EAP WPA-EAP-SHA256")
+	setRaw("ieee80211w", "1")
+	setRaw("eap", eap)
+	set("identity", creds.Identity)
+
+	if creds.AnonymousIdentity != "" {
+		set("anonymous_identity", creds.AnonymousIdentity)
+	}
+
+	if eap != "TLS" {
+		set("password", creds.Password)
+		phase2 := creds.Phase2
+		if phase2 == "" {
+			phase2 = "MSCHAPV2"
+		}
+		if !strings.Contains(phase2, "=") {
+			phase2 = "auth=" + strings.ToUpper(phase2)
+		}
+		set("phase2", phase2)
+	}
+
+	if path, ok := certs["ca"]; ok {
+		set("ca_cert", path)
+	}
+	if creds.DomainSuffixMatch != "" {
+		set("domain_suffix_match", creds.DomainSuffixMatch)
+	}
+	if path, ok := certs["client"]; ok {
+		set("client_cert", path)
+	}
+	if path, ok := certs["key"]; ok {
+		set("private_key", path)
+		if creds.PrivateKeyPassword != "" {
+			set("private_key_passwd", creds.PrivateKeyPassword)
+		}
+	}
+
+	if setErr != nil {
+		// the id is returned so that the half configured network is removed
+		return i, setErr
+	}
+
+	m.Backend.SelectNetwork(i)
+	m.Backend.SaveConfiguration()
+
+	return i, nil
+}
+
+// writeEnterpriseCerts stores the PEM blobs in the credentials and returns their paths keyed by "ca", "client" and "key"
+func writeEnterpriseCerts(creds *WifiCredentials) (map[string]string, error) {
+	paths := make(map[string]string)
+
+	blobs := map[string]string{
+		"ca":     creds.CACert,
+		"client": creds.ClientCert,
+		"key":    creds.PrivateKey,
+	}
+
+	prefix := fmt.Sprintf("%x", sha256.Sum256([]byte(creds.SSID)))[:12]
+
+	for kind, pem := range blobs {
+		if pem == "" {
+			continue
+		}
+		if !strings.Contains(pem, "-----BEGIN ") {
+			return nil, fmt.Errorf("%s certificate for %s is not PEM encoded", kind, creds.SSID)
+		}
+		if err := os.MkdirAll(EnterpriseCertDir, 0700); err != nil {
+			return nil, err
+		}
+		path := filepath.Join(EnterpriseCertDir, prefix+"-"+kind+".pem")
+		if err := ioutil.WriteFile(path, []byte(pem), 0600); err != nil {
+			return nil, err
+		}
+		paths[kind] = path
+	}
+
+	return paths, nil
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ninjasphere/go-ninja/api"
+	"github.com/ninjasphere/go-ninja/config"
+)
+
+const (
+	// how often the link is sampled while associated
+	LinkSampleInterval = time.Second * 10
+	// how many samples are kept, an hour's worth
+	LinkHistorySize = 360
+	// how often a summary is published over mqtt
+	LinkSummaryInterval = time.Minute * 5
+)
+
+// LinkSample is one reading of SIGNAL_POLL
+type LinkSample struct {
+	Time      time.Time `json:"time"`
+	RSSI      int       `json:"rssi"`      // dBm
+	LinkSpeed int       `json:"linkSpeed"` // Mbit/s
+	Noise     int       `json:"noise"`     // dBm, 0 if the driver doesn't report it
+	Frequency int       `json:"frequency"` // MHz
+}
+
+// LinkSummary condenses the history, for publishing and for a quick look by support
+type LinkSummary struct {
+	Connected   bool   `json:"connected"`
+	SSID        string `json:"ssid,omitempty"`
+	BSSID       string `json:"bssid,omitempty"`
+	Frequency   int    `json:"frequency,omitempty"`
+	Samples     int    `json:"samples"`
+	RSSI        int    `json:"rssi"` // the latest reading
+	MinRSSI     int    `json:"minRssi"`
+	MaxRSSI     int    `json:"maxRssi"`
+	AverageRSSI int    `json:"averageRssi"`
+	Quality     int    `json:"quality"` // 0-100%, from the average rssi
+	LinkSpeed   int    `json:"linkSpeed"`
+	Noise       int    `json:"noise"`
+	BeaconLoss  int    `json:"beaconLoss"`  // beacon loss events since startup
+	Reconnects  int    `json:"reconnects"`  // associations after the first one
+	Disconnects int    `json:"disconnects"` // disconnections since startup
+}
+
+// LinkQuality is the summary along with the samples it was made from
+type LinkQuality struct {
+	Summary LinkSummary  `json:"summary"`
+	History []LinkSample `json:"history"`
+}
+
+// linkMonitor keeps the rolling history of samples and the event counters
+type linkMonitor struct {
+	sync.Mutex
+	history     []LinkSample
+	connects    int
+	disconnects int
+	beaconLoss  int
+}
+
+func (l *linkMonitor) add(sample LinkSample) {
+	l.Lock()
+	defer l.Unlock()
+	l.history = append(l.history, sample)
+	if len(l.history) > LinkHistorySize {
+		l.history = l.history[len(l.history)-LinkHistorySize:]
+	}
+}
+
+// countEvent updates the counters for the events that say something about the link
+func (l *linkMonitor) countEvent(name string) {
+	l.Lock()
+	defer l.Unlock()
+	switch name {
+	case "CTRL-EVENT-CONNECTED":
+		l.connects++
+	case "CTRL-EVENT-DISCONNECTED":
+		l.disconnects++
+	case "CTRL-EVENT-BEACON-LOSS":
+		l.beaconLoss++
+	}
+}
+
+// LinkQuality returns the history of samples and a summary of the current link
+func (m *WifiManager) LinkQuality() *LinkQuality {
+	m.link.Lock()
+	history := make([]LinkSample, len(m.link.history))
+	copy(history, m.link.history)
+	summary := LinkSummary{
+		Samples:     len(history),
+		BeaconLoss:  m.link.beaconLoss,
+		Disconnects: m.link.disconnects,
+	}
+	if m.link.connects > 1 {
+		summary.Reconnects = m.link.connects - 1
+	}
+	m.link.Unlock()
+
+	if status, err := m.Status(); err == nil && status["wpa_state"] == "COMPLETED" {
+		summary.Connected = true
+		summary.SSID = strings.Trim(status["ssid"], "\"")
+		summary.BSSID = status["bssid"]
+		summary.Frequency, _ = statusInt(status, "freq")
+	}
+
+	if len(history) > 0 {
+		latest := history[len(history)-1]
+		summary.RSSI = latest.RSSI
+		summary.LinkSpeed = latest.LinkSpeed
+		summary.Noise = latest.Noise
+
+		summary.MinRSSI, summary.MaxRSSI = latest.RSSI, latest.RSSI
+		total := 0
+		for _, sample := range history {
+			total += sample.RSSI
+			if sample.RSSI < summary.MinRSSI {
+				summary.MinRSSI = sample.RSSI
+			}
+			if sample.RSSI > summary.MaxRSSI {
+				summary.MaxRSSI = sample.RSSI
+			}
+		}
+		summary.AverageRSSI = total / len(history)
+		summary.Quality = signalQuality(summary.AverageRSSI)
+	}
+
+	return &LinkQuality{summary, history}
+}
+
+// linkQualityLoop samples the link while associated
+func (m *WifiManager) linkQualityLoop() {
+	for {
+		time.Sleep(LinkSampleInterval)
+
+		m.connLock.Lock()
+		associated := m.associated
+		m.connLock.Unlock()
+		if !associated {
+			continue
+		}
+
+		poll, err := m.Backend.SignalPoll()
+		if err != nil {
+			logger.Debugf("linkQualityLoop: SIGNAL_POLL failed: %v", err)
+			continue
+		}
+
+		sample := LinkSample{Time: time.Now()}
+		sample.RSSI, _ = statusInt(poll, "RSSI")
+		sample.LinkSpeed, _ = statusInt(poll, "LINKSPEED")
+		sample.Noise, _ = statusInt(poll, "NOISE")
+		sample.Frequency, _ = statusInt(poll, "FREQUENCY")
+		if sample.Noise == 9999 {
+			// wpa_supplicant's way of saying the driver doesn't know
+			sample.Noise = 0
+		}
+
+		m.link.add(sample)
+	}
+}
+
+// publishLinkQuality periodically publishes the link summary over mqtt, so that support can see
+// how well a sphere is placed without logging in to it
+func publishLinkQuality(conn *ninja.Connection, wifi_manager *WifiManager) {
+	topic := fmt.Sprintf("$node/%s/wifi/link-quality", config.Serial())
+	for {
+		time.Sleep(LinkSummaryInterval)
+
+		summary := wifi_manager.LinkQuality().Summary
+		if err := conn.SendNotification(topic, summary); err != nil {
+			logger.Warningf("Failed to publish link quality: %v", err)
+		}
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+// the country chosen by the user, which overrides the one in the configuration file
+const CountryFile = "/data/etc/wifi-country"
+
+// the world regulatory domain, which only allows what is allowed everywhere
+const WorldCountry = "00"
+
+// RegulatoryDomain lists the channels that a country allows. DFS channels need radar detection,
+// so an access point can't use them, but a client can join networks on them.
+type RegulatoryDomain struct {
+	Country    string `json:"country"`
+	Channels24 []int  `json:"channels24"`
+	Channels5  []int  `json:"channels5"`
+	DFS        []int  `json:"dfs"` // the 5GHz channels that require radar detection
+}
+
+var (
+	channels1to11 = []int{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11}
+	channels1to13 = []int{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13}
+
+	unii1   = []int{36, 40, 44, 48}
+	unii2   = []int{52, 56, 60, 64}
+	unii2e  = []int{100, 104, 108, 112, 116, 120, 124, 128, 132, 136, 140}
+	unii2ex = []int{100, 104, 108, 112, 116, 120, 124, 128, 132, 136, 140, 144}
+	unii3   = []int{149, 153, 157, 161, 165}
+)
+
+// joinChannels concatenates channel lists
+func joinChannels(lists ...[]int) []int {
+	channels := []int{}
+	for _, list := range lists {
+		channels = append(channels, list...)
+	}
+	return channels
+}
+
+// a (deliberately conservative) summary of the regulatory database, for the countries we ship to
+var regulatoryDomains = map[string]RegulatoryDomain{
+	WorldCountry: {WorldCountry, channels1to11, unii1, nil},
+	"US":         {"US", channels1to11, joinChannels(unii1, unii2, unii2ex, unii3), joinChannels(unii2, unii2ex)},
+	"CA":         {"CA", channels1to11, joinChannels(unii1, unii2, unii2ex, unii3), joinChannels(unii2, unii2ex)},
+	"MX":         {"MX", channels1to11, joinChannels(unii1, unii2, unii2e, unii3), joinChannels(unii2, unii2e)},
+	"AU":         {"AU", channels1to13, joinChannels(unii1, unii2, unii2ex, unii3), joinChannels(unii2, unii2ex)},
+	"NZ":         {"NZ", channels1to13, joinChannels(unii1, unii2, unii2ex, unii3), joinChannels(unii2, unii2ex)},
+	"GB":         {"GB", channels1to13, joinChannels(unii1, unii2, unii2e), joinChannels(unii2, unii2e)},
+	"IE":         {"IE", channels1to13, joinChannels(unii1, unii2, unii2e), joinChannels(unii2, unii2e)},
+	"DE":         {"DE", channels1to13, joinChannels(unii1, unii2, unii2e), joinChannels(unii2, unii2e)},
+	"FR":         {"FR", channels1to13, joinChannels(unii1, unii2, unii2e), joinChannels(unii2, unii2e)},
+	"NL":         {"NL", channels1to13, joinChannels(unii1, unii2, unii2e), joinChannels(unii2, unii2e)},
+	"BE":         {"BE", channels1to13, joinChannels(unii1, unii2, unii2e), joinChannels(unii2, unii2e)},
+	"ES":         {"ES", channels1to13, joinChannels(unii1, unii2, unii2e), joinChannels(unii2, unii2e)},
+	"IT":         {"IT", channels1to13, joinChannels(unii1, unii2, unii2e), joinChannels(unii2, unii2e)},
+	"SE":         {"SE", channels1to13, joinChannels(unii1, unii2, unii2e), joinChannels(unii2, unii2e)},
+	"DK":         {"DK", channels1to13, joinChannels(unii1, unii2, unii2e), joinChannels(unii2, unii2e)},
+	"NO":         {"NO", channels1to13, joinChannels(unii1, unii2, unii2e), joinChannels(unii2, unii2e)},
+	"CH":         {"CH", channels1to13, joinChannels(unii1, unii2, unii2e), joinChannels(unii2, unii2e)},
+	"JP":         {"JP", channels1to13, joinChannels(unii1, unii2, unii2ex), joinChannels(unii2, unii2ex)},
+	"KR":         {"KR", channels1to13, joinChannels(unii1, unii2, unii2e, unii3), joinChannels(unii2, unii2e)},
+	"CN":         {"CN", channels1to13, joinChannels(unii1, unii2, unii3), unii2},
+	"SG":         {"SG", channels1to13, joinChannels(unii1, unii2, unii2ex, unii3), joinChannels(unii2, unii2ex)},
+	"IN":         {"IN", channels1to13, joinChannels(unii1, unii2, unii2e, unii3), joinChannels(unii2, unii2e)},
+	"BR":         {"BR", channels1to13, joinChannels(unii1, unii2, unii2ex, unii3), joinChannels(unii2, unii2ex)},
+	"ZA":         {"ZA", channels1to13, joinChannels(unii1, unii2, unii2e), joinChannels(unii2, unii2e)},
+}
+
+// LookupRegulatoryDomain returns the channels allowed in a country (an ISO 3166-1 alpha2 code, or 00)
+func LookupRegulatoryDomain(country string) (RegulatoryDomain, error) {
+	domain, ok := regulatoryDomains[strings.ToUpper(country)]
+	if !ok {
+		return RegulatoryDomain{}, fmt.Errorf("unsupported country: %s", country)
+	}
+	return domain, nil
+}
+
+// AllowsChannel returns true if the channel may be used at all
+func (d RegulatoryDomain) AllowsChannel(channel int) bool {
+	return containsChannel(d.Channels24, channel) || containsChannel(d.Channels5, channel)
+}
+
+// AllowsAPChannel returns true if an access point may be started on the channel
+func (d RegulatoryDomain) AllowsAPChannel(channel int) bool {
+	return d.AllowsChannel(channel) && !containsChannel(d.DFS, channel)
+}
+
+func containsChannel(channels []int, channel int) bool {
+	for _, c := range channels {
+		if c == channel {
+			return true
+		}
+	}
+	return false
+}
+
+// LoadCountry returns the country chosen with set_country, or the configured one
+func LoadCountry(config AssistantConfig) string {
+	if data, err := ioutil.ReadFile(CountryFile); err == nil {
+		country := strings.ToUpper(strings.TrimSpace(string(data)))
+		if _, err := LookupRegulatoryDomain(country); err == nil {
+			return country
+		}
+		logger.Warningf("Ignoring unsupported country in %s: %s", CountryFile, country)
+	}
+
+	country := strings.ToUpper(config.Regulatory.Country)
+	if _, err := LookupRegulatoryDomain(country); err != nil {
+		logger.Warningf("Ignoring unsupported country in the configuration: %s", country)
+		return WorldCountry
+	}
+	return country
+}
+
+// SaveCountry remembers the country chosen with set_country
+func SaveCountry(country string) error {
+	return ioutil.WriteFile(CountryFile, []byte(country+"\n"), 0644)
+}
+
+// SetCountry sets the regulatory domain that wpa_supplicant uses, and saves it to its configuration
+func (m *WifiManager) SetCountry(country string) error {
+	logger.Infof("SetCountry: %s", country)
+	if err := m.Backend.SetCountry(country); err != nil {
+		return err
+	}
+	return m.Backend.SaveConfiguration()
+}
+
+// ApplyCountry validates the country and reconfigures both wpa_supplicant and hostapd for it,
+// saving it for the next boot only once they have both accepted it
+func ApplyCountry(country string, wifi_manager *WifiManager, apManager *AccessPointManager) (RegulatoryDomain, error) {
+	domain, err := LookupRegulatoryDomain(country)
+	if err != nil {
+		return domain, err
+	}
+
+	if err := wifi_manager.SetCountry(domain.Country); err != nil {
+		return domain, err
+	}
+	if err := apManager.SetCountry(domain.Country); err != nil {
+		return domain, err
+	}
+	if err := SaveCountry(domain.Country); err != nil {
+		return domain, err
+	}
+
+	return domain, nil
+}
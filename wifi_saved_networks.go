@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// a network from the wpa_supplicant configuration, as reported to the app
+type SavedNetwork struct {
+	Id       int    `json:"id"`
+	SSID     string `json:"ssid"`
+	Priority int    `json:"priority"`
+	Enabled  bool   `json:"enabled"`
+	Current  bool   `json:"current"`
+}
+
+// Status returns the key=value pairs reported by wpa_supplicant's STATUS command
+func (m *WifiManager) Status() (map[string]string, error) {
+	return m.Backend.Status()
+}
+
+func (m *WifiManager) ListSavedNetworks() ([]SavedNetwork, error) {
+	networks, err := m.Backend.ListNetworks()
+	if err != nil {
+		return nil, err
+	}
+
+	currentId := -1
+	if status, err := m.Status(); err == nil && status["wpa_state"] == "COMPLETED" {
+		if id, ok := statusInt(status, "id"); ok {
+			currentId = id
+		}
+	}
+
+	saved := make([]SavedNetwork, len(networks))
+	for i, id := range networks {
+		saved[i].Id = id
+		saved[i].Current = id == currentId
+
+		ssid, _ := m.Backend.GetNetworkSetting(id, "ssid")
+		saved[i].SSID = strings.Trim(ssid, "\"")
+
+		priority, _ := m.Backend.GetNetworkSetting(id, "priority")
+		saved[i].Priority, _ = strconv.Atoi(priority)
+
+		disabled, _ := m.Backend.GetNetworkSetting(id, "disabled")
+		saved[i].Enabled = disabled != "1"
+	}
+
+	return saved, nil
+}
+
+// checkNetworkExists makes sure id refers to a configured network, so that we report a sensible error to the app
+func (m *WifiManager) checkNetworkExists(id int) error {
+	networks, err := m.Backend.ListNetworks()
+	if err != nil {
+		return err
+	}
+	for _, network := range networks {
+		if network == id {
+			return nil
+		}
+	}
+	return fmt.Errorf("no saved network with id %d", id)
+}
+
+func (m *WifiManager) ForgetNetwork(id int) error {
+	if err := m.checkNetworkExists(id); err != nil {
+		return err
+	}
+	logger.Infof("ForgetNetwork: removing network %d", id)
+	if err := m.Backend.RemoveNetwork(id); err != nil {
+		return err
+	}
+	return m.Backend.SaveConfiguration()
+}
+
+func (m *WifiManager) SetNetworkPriority(id int, priority int) error {
+	if err := m.checkNetworkExists(id); err != nil {
+		return err
+	}
+	if priority < 0 {
+		return fmt.Errorf("priority must not be negative")
+	}
+	logger.Infof("SetNetworkPriority: network %d priority %d", id, priority)
+	if err := m.Backend.SetNetworkSettingRaw(id, "priority", strconv.Itoa(priority)); err != nil {
+		return err
+	}
+	return m.Backend.SaveConfiguration()
+}
+
+func (m *WifiManager) EnableNetwork(id int, enabled bool) error {
+	if err := m.checkNetworkExists(id); err != nil {
+		return err
+	}
+	logger.Infof("EnableNetwork: network %d enabled %t", id, enabled)
+	var err error
+	if enabled {
+		err = m.Backend.EnableNetwork(id)
+	} else {
+		err = m.Backend.DisableNetwork(id)
+	}
+	if err != nil {
+		return err
+	}
+	return m.Backend.SaveConfiguration()
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// security types understood by WifiManager when configuring a network
+const (
+	WifiSecurityOpen       = "open"
+	WifiSecurityWEP        = "wep"
+	WifiSecurityWPAPSK     = "wpa-psk"
+	WifiSecuritySAE        = "wpa3-sae"
+	WifiSecurityTransition = "wpa2-wpa3" // WPA2-PSK/WPA3-SAE transition mode
+	WifiSecurityEnterprise = "enterprise"
+)
+
+// a single BSS as reported by wpa_supplicant's SCAN_RESULTS
+type ScanResult struct {
+	BSSID     string
+	Frequency int
+	Signal    int
+	Flags     string
+	SSID      string
+}
+
+// Security derives one of the WifiSecurity* constants from the scan flags
+func (r *ScanResult) Security() string {
+	return SecurityFromFlags(r.Flags)
+}
+
+// SecurityFromFlags maps wpa_supplicant flags such as "[WPA2-PSK-CCMP][ESS]" to a security type
+func SecurityFromFlags(flags string) string {
+	switch {
+	case strings.Contains(flags, "EAP"):
+		return WifiSecurityEnterprise
+	case strings.Contains(flags, "SAE") && strings.Contains(flags, "PSK"):
+		return WifiSecurityTransition
+	case strings.Contains(flags, "SAE"):
+		return WifiSecuritySAE
+	case strings.Contains(flags, "PSK"):
+		return WifiSecurityWPAPSK
+	case strings.Contains(flags, "WEP"):
+		return WifiSecurityWEP
+	default:
+		return WifiSecurityOpen
+	}
+}
+
+// parseScanResults parses the tab separated output of SCAN_RESULTS, skipping the header line
+func parseScanResults(raw string) []ScanResult {
+	results := make([]ScanResult, 0)
+
+	for _, line := range strings.Split(raw, "\n") {
+		fields := strings.Split(strings.TrimRight(line, "\r"), "\t")
+		if len(fields) < 4 || strings.HasPrefix(line, "bssid /") {
+			continue
+		}
+
+		result := ScanResult{
+			BSSID: fields[0],
+			Flags: fields[3],
+		}
+		result.Frequency, _ = strconv.Atoi(fields[1])
+		result.Signal, _ = strconv.Atoi(fields[2])
+		if len(fields) > 4 {
+			result.SSID = fields[4]
+		}
+
+		results = append(results, result)
+	}
+
+	return results
+}
+
+// ScanResults returns the BSS table currently held by wpa_supplicant
+func (m *WifiManager) ScanResults() ([]ScanResult, error) {
+	return m.Backend.ScanResults()
+}
+
+// LookupSecurity finds the security type advertised by the strongest BSS with the given SSID
+func (m *WifiManager) LookupSecurity(ssid string) (string, bool) {
+	results, err := m.ScanResults()
+	if err != nil {
+		logger.Warningf("LookupSecurity: failed to read scan results: %v", err)
+		return "", false
+	}
+
+	var best *ScanResult
+	for i, result := range results {
+		if result.SSID != ssid {
+			continue
+		}
+		if best == nil || result.Signal > best.Signal {
+			best = &results[i]
+		}
+	}
+
+	if best == nil {
+		return "", false
+	}
+	return best.Security(), true
+}
+
+// the outcome of a scan, grouped by SSID
+type WifiScan struct {
+	Time     time.Time
+	Networks []WifiNetwork       // visible networks, strongest first
+	Hidden   []HiddenWifiNetwork // access points not broadcasting an SSID, strongest first
+}
+
+const (
+	// how often the background scanner asks wpa_supplicant for a scan
+	BackgroundScanInterval = time.Minute
+	// how old the cached results may be when the app doesn't say
+	DefaultScanMaxAge = time.Second * 10
+	// how long to wait for wpa_supplicant to report the results of a scan
+	ScanTimeout = time.Second * 10
+)
+
+// ScanNetworks returns the cached scan results if they are younger than maxAge, otherwise it asks
+// wpa_supplicant for a fresh scan. Scanning doesn't disturb the current connection.
+func (m *WifiManager) ScanNetworks(maxAge time.Duration) (*WifiScan, error) {
+	m.scanLock.Lock()
+	scan := m.lastScan
+	if scan != nil && time.Since(scan.Time) <= maxAge {
+		m.scanLock.Unlock()
+		return scan, nil
+	}
+	if m.scanDone == nil {
+		m.scanDone = make(chan bool)
+		if err := m.Backend.TriggerScan(); err != nil {
+			close(m.scanDone)
+			m.scanDone = nil
+			m.scanLock.Unlock()
+			return nil, err
+		}
+	}
+	done := m.scanDone
+	m.scanLock.Unlock()
+
+	select {
+	case <-done:
+	case <-time.After(ScanTimeout):
+		logger.Warningf("ScanNetworks: no scan results after %s, using what wpa_supplicant has", ScanTimeout)
+		m.updateScanCache(false)
+		// give up on this scan even if we couldn't read the results, so the next caller asks for another
+		m.scanLock.Lock()
+		if m.scanDone == done {
+			close(m.scanDone)
+			m.scanDone = nil
+		}
+		m.scanLock.Unlock()
+	}
+
+	m.scanLock.Lock()
+	defer m.scanLock.Unlock()
+	if m.lastScan == nil {
+		return nil, fmt.Errorf("no scan results")
+	}
+	return m.lastScan, nil
+}
+
+// LastScan returns the results of the most recent scan, scanning if there hasn't been one
+func (m *WifiManager) LastScan() (*WifiScan, error) {
+	return m.ScanNetworks(time.Duration(math.MaxInt64))
+}
+
+// updateScanCache reads the BSS table from wpa_supplicant into the cache, waking anyone waiting for a scan.
+// It is called whenever wpa_supplicant reports scan results, whoever asked for the scan, and with
+// completed false when a scan timed out, in which case the results keep the time of the last scan
+// that completed so they aren't taken as fresh.
+func (m *WifiManager) updateScanCache(completed bool) {
+	results, err := m.ScanResults()
+	if err != nil {
+		logger.Warningf("updateScanCache: failed to read scan results: %v", err)
+		return
+	}
+
+	scan := summariseScan(results)
+
+	m.scanLock.Lock()
+	defer m.scanLock.Unlock()
+
+	if !completed {
+		scan.Time = time.Time{}
+		if m.lastScan != nil {
+			scan.Time = m.lastScan.Time
+		}
+	}
+	m.lastScan = scan
+	if m.scanDone != nil {
+		close(m.scanDone)
+		m.scanDone = nil
+	}
+}
+
+// scanLoop keeps the scan cache fresh in the background
+func (m *WifiManager) scanLoop() {
+	for {
+		if _, err := m.ScanNetworks(BackgroundScanInterval / 2); err != nil {
+			logger.Warningf("Background scan failed: %v", err)
+		}
+		time.Sleep(BackgroundScanInterval)
+	}
+}
+
+func summariseScan(results []ScanResult) *WifiScan {
+	scan := &WifiScan{
+		Time:     time.Now(),
+		Networks: make([]WifiNetwork, 0),
+		Hidden:   make([]HiddenWifiNetwork, 0),
+	}
+
+	bySSID := make(map[string]int)
+
+	for _, result := range results {
+		if isHiddenSSID(result.SSID) {
+			scan.Hidden = append(scan.Hidden, HiddenWifiNetwork{
+				BSSID:     result.BSSID,
+				RSSI:      result.Signal,
+				Quality:   signalQuality(result.Signal),
+				Security:  result.Security(),
+				Frequency: result.Frequency,
+				Channel:   frequencyToChannel(result.Frequency),
+				Band:      frequencyBand(result.Frequency),
+			})
+			continue
+		}
+
+		i, ok := bySSID[result.SSID]
+		if !ok {
+			i = len(scan.Networks)
+			bySSID[result.SSID] = i
+			scan.Networks = append(scan.Networks, WifiNetwork{SSID: result.SSID})
+		}
+
+		network := &scan.Networks[i]
+		network.BSSIDs++
+		if strings.Contains(result.Flags, "WPS") {
+			network.WPS = true
+		}
+		if network.BSSIDs > 1 && result.Signal <= network.RSSI {
+			continue
+		}
+
+		// the strongest access point decides what we report
+		network.RSSI = result.Signal
+		network.Quality = signalQuality(result.Signal)
+		network.Security = result.Security()
+		network.Secured = network.Security != WifiSecurityOpen
+		network.Enterprise = network.Security == WifiSecurityEnterprise
+		network.Frequency = result.Frequency
+		network.Channel = frequencyToChannel(result.Frequency)
+		network.Band = frequencyBand(result.Frequency)
+	}
+
+	sort.SliceStable(scan.Networks, func(i, j int) bool {
+		return scan.Networks[i].RSSI > scan.Networks[j].RSSI
+	})
+	sort.SliceStable(scan.Hidden, func(i, j int) bool {
+		return scan.Hidden[i].RSSI > scan.Hidden[j].RSSI
+	})
+
+	return scan
+}
+
+// wpa_supplicant reports hidden SSIDs as empty or as a run of escaped NULs
+func isHiddenSSID(ssid string) bool {
+	return strings.Replace(ssid, "\\x00", "", -1) == ""
+}
+
+// signalQuality maps -100dBm..-50dBm onto 0..100%
+func signalQuality(dbm int) int {
+	quality := 2 * (dbm + 100)
+	if quality < 0 {
+		return 0
+	}
+	if quality > 100 {
+		return 100
+	}
+	return quality
+}
+
+func frequencyToChannel(freq int) int {
+	switch {
+	case freq == 2484:
+		return 14
+	case freq >= 2412 && freq < 2484:
+		return (freq - 2407) / 5
+	case freq >= 5000 && freq < 5900:
+		return (freq - 5000) / 5
+	default:
+		return 0
+	}
+}
+
+func frequencyBand(freq int) string {
+	switch {
+	case freq >= 2400 && freq < 2500:
+		return "2.4GHz"
+	case freq >= 4900 && freq < 5900:
+		return "5GHz"
+	default:
+		return ""
+	}
+}
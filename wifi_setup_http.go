@@ -6,15 +6,16 @@ import (
 	"io/ioutil"
 	"net/http"
 	"os/exec"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/ninjasphere/gatt"
 	"github.com/ninjasphere/go-ninja/api"
 	"github.com/ninjasphere/go-ninja/config"
-	"github.com/ninjasphere/go-wireless/iwlib"
 )
 
-func StartHTTPServer(conn *ninja.Connection, wifi_manager *WifiManager, srv *gatt.Server, pairing_ui ConsolePairingUI) {
+func StartHTTPServer(conn *ninja.Connection, wifi_manager *WifiManager, connectivity *ConnectivityMonitor, apManager *AccessPointManager, srv *gatt.Server, pairing_ui ConsolePairingUI) {
 
 	http.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
 
@@ -27,11 +28,23 @@ func StartHTTPServer(conn *ninja.Connection, wifi_manager *WifiManager, srv *gat
 			"nodeId": config.Serial(),
 		}
 
-		if ip, ipErr := GetWlanAddress(); ipErr == nil {
+		if ip, ipErr := wifi_manager.Address(); ipErr == nil {
 			logger.Infof("Have wlan ip: %s", ip)
 			data["wlanIp"] = ip
 		}
 
+		if portal := wifi_manager.Portal(); portal != nil {
+			data["portal"] = portal
+		}
+
+		data["apChannel"] = apManager.ChannelStatus()
+
+		uplink := connectivity.Uplink()
+		data["uplink"] = uplink.Uplink
+		if uplink.Interface != "" {
+			data["uplinkInterface"] = uplink.Interface
+		}
+
 		if config.IsPaired() {
 			logger.Infof("Is paired. Adding site and user info")
 			data["siteId"] = config.MustString("siteId")
@@ -51,18 +64,16 @@ func StartHTTPServer(conn *ninja.Connection, wifi_manager *WifiManager, srv *gat
 
 		pairing_ui.DisplayIcon("wifi-searching.gif")
 
-		// Before we search for wifi networks, disable any that are try-fail-ing
-		wifi_manager.DisableAllNetworks()
+		// optionally, ?maxAge=<seconds> says how old the cached results may be
+		var scan_request ScanRequest
+		if maxAge, err := strconv.Atoi(r.URL.Query().Get("maxAge")); err == nil {
+			scan_request.MaxAge = &maxAge
+		}
 
-		networks, err := iwlib.GetWirelessNetworks("wlan0")
+		scan, err := wifi_manager.ScanNetworks(scan_request.MaxAgeDuration())
 
 		if err == nil {
-			wifi_networks := make([]WifiNetwork, len(networks))
-			for i, network := range networks {
-				wifi_networks[i].SSID = network.SSID
-			}
-
-			out, err := json.Marshal(wifi_networks)
+			out, err := json.Marshal(scan.Networks)
 			if err != nil {
 				http.Error(w, err.Error(), http.StatusInternalServerError)
 				return
@@ -75,6 +86,23 @@ func StartHTTPServer(conn *ninja.Connection, wifi_manager *WifiManager, srv *gat
 
 	})
 
+	http.HandleFunc("/get_hidden_wifi_networks", func(w http.ResponseWriter, r *http.Request) {
+
+		scan, err := wifi_manager.LastScan()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		out, err := json.Marshal(scan.Hidden)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		io.WriteString(w, string(out))
+	})
+
 	http.HandleFunc("/connect_wifi_network", func(w http.ResponseWriter, r *http.Request) {
 
 		pairing_ui.DisplayIcon("wifi-connecting.gif")
@@ -92,36 +120,96 @@ func StartHTTPServer(conn *ninja.Connection, wifi_manager *WifiManager, srv *gat
 
 		logger.Infof("Got wifi credentials %v", wifi_creds)
 
-		done := make(chan bool, 2)
+		done := make(chan *ConnectResult, 2)
 
 		go func() {
 			done <- wifi_manager.SetCredentials(&wifi_creds)
 		}()
 
 		select {
-		case success := <-done:
+		case result := <-done:
 
-			logger.Infof("Wifi success? %t", success)
+			logger.Infof("Wifi result: %v", result)
 
-			if success {
-				pairing_ui.DisplayIcon("wifi-connected.gif")
+			pairing_ui.DisplayIcon(result.Icon())
+
+			if result.Success {
 				serial_number, err := exec.Command("/opt/ninjablocks/bin/sphere-serial").Output()
 				if err != nil {
 					http.Error(w, err.Error(), http.StatusInternalServerError)
 					return
 				}
-				io.WriteString(w, "\""+string(serial_number)+"\"")
+				result.Serial = strings.TrimSpace(string(serial_number))
+				out, _ := json.Marshal(result)
+				io.WriteString(w, string(out))
 			} else {
-				pairing_ui.DisplayIcon("wifi-failed.gif")
-				http.Error(w, "Could not connect to specified WiFi network, is the key correct?", http.StatusBadRequest)
+				writeConnectFailure(w, result)
 			}
 
-		case <-time.After(time.Second * 15):
-			pairing_ui.DisplayIcon("wifi-failed.gif")
-			http.Error(w, "Could not connect to specified WiFi network, is it in range?", http.StatusBadRequest)
+		case <-time.After(wifi_manager.ConnectTimeout() + ConnectResponseGrace):
+			result := connectFailed(wifi_creds.SSID, ConnectReasonTimeout, "")
+			pairing_ui.DisplayIcon(result.Icon())
+			writeConnectFailure(w, result)
 		}
 	})
 
+	http.HandleFunc("/list_saved_networks", func(w http.ResponseWriter, r *http.Request) {
+
+		networks, err := wifi_manager.ListSavedNetworks()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		out, err := json.Marshal(networks)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		io.WriteString(w, string(out))
+	})
+
+	http.HandleFunc("/forget_network", savedNetworkHTTPHandler("", func(change *SavedNetworkChange) error {
+		return wifi_manager.ForgetNetwork(*change.Id)
+	}))
+
+	http.HandleFunc("/set_network_priority", savedNetworkHTTPHandler("priority", func(change *SavedNetworkChange) error {
+		return wifi_manager.SetNetworkPriority(*change.Id, *change.Priority)
+	}))
+
+	http.HandleFunc("/enable_network", savedNetworkHTTPHandler("enabled", func(change *SavedNetworkChange) error {
+		return wifi_manager.EnableNetwork(*change.Id, *change.Enabled)
+	}))
+
+	http.HandleFunc("/get_link_quality", func(w http.ResponseWriter, r *http.Request) {
+
+		out, err := json.Marshal(wifi_manager.LinkQuality())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		io.WriteString(w, string(out))
+	})
+
+	http.HandleFunc("/list_ap_clients", func(w http.ResponseWriter, r *http.Request) {
+
+		clients, err := apManager.ListClients()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		out, err := json.Marshal(clients)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		io.WriteString(w, string(out))
+	})
+
 	http.HandleFunc("/close_ble_central", func(w http.ResponseWriter, r *http.Request) {
 		err := srv.Close()
 
@@ -181,7 +269,7 @@ func StartHTTPServer(conn *ninja.Connection, wifi_manager *WifiManager, srv *gat
 
 		http.HandleFunc("/get_wifi_ip", func(w http.ResponseWriter, r *http.Request) {
 
-			ip, err := GetWlanAddress()
+			ip, err := wifi_manager.Address()
 			if err != nil {
 				http.Error(w, err.Error(), http.StatusInternalServerError)
 				return
@@ -205,3 +293,42 @@ func StartHTTPServer(conn *ninja.Connection, wifi_manager *WifiManager, srv *gat
 	}()
 
 }
+
+// writeConnectFailure replies with the failed result as a JSON-RPC error, as the rpc api does
+func writeConnectFailure(w http.ResponseWriter, result *ConnectResult) {
+	out, _ := json.Marshal(result.RPCError())
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(result.HTTPStatus())
+	w.Write(out)
+}
+
+// savedNetworkHTTPHandler decodes a SavedNetworkChange from the request body and applies it
+func savedNetworkHTTPHandler(requires string, apply func(change *SavedNetworkChange) error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		body, err := ioutil.ReadAll(r.Body)
+
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		var change SavedNetworkChange
+
+		if err := json.Unmarshal(body, &change); err != nil {
+			http.Error(w, "Expected a network id", http.StatusBadRequest)
+			return
+		}
+		if missing := change.missing(requires); missing != "" {
+			http.Error(w, "Expected "+missing, http.StatusBadRequest)
+			return
+		}
+
+		if err := apply(&change); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		io.WriteString(w, "true")
+	}
+}
@@ -4,30 +4,135 @@ import (
 	"encoding/json"
 	"fmt"
 	"os/exec"
+	"strings"
 	"time"
 
 	"github.com/ninjasphere/go-ninja/api"
 	"github.com/ninjasphere/go-ninja/config"
-	"github.com/ninjasphere/go-wireless/iwlib"
 	"github.com/ninjasphere/gatt"
 )
 
 type WifiNetwork struct {
-	SSID string `json:"name"`
+	SSID       string `json:"name"`
+	RSSI       int    `json:"rssi"`    // dBm of the strongest BSS
+	Quality    int    `json:"quality"` // 0-100%
+	Security   string `json:"security"`
+	Secured    bool   `json:"secured"`
+	Enterprise bool   `json:"enterprise"`
+	WPS        bool   `json:"wps"`
+	Frequency  int    `json:"frequency"` // MHz
+	Channel    int    `json:"channel"`
+	Band       string `json:"band"`   // "2.4GHz" or "5GHz"
+	BSSIDs     int    `json:"bssids"` // number of access points seen with this SSID
+}
+
+// an access point that doesn't broadcast its SSID
+type HiddenWifiNetwork struct {
+	BSSID     string `json:"bssid"`
+	RSSI      int    `json:"rssi"`
+	Quality   int    `json:"quality"`
+	Security  string `json:"security"`
+	Frequency int    `json:"frequency"`
+	Channel   int    `json:"channel"`
+	Band      string `json:"band"`
 }
 
 type WifiCredentials struct {
 	SSID string `json:"ssid"`
 	Key  string `json:"key"`
+
+	// One of the WifiSecurity* constants. When empty, it is taken from the scan results.
+	Security string `json:"security,omitempty"`
+
+	// 802.1X (WPA2/WPA3-Enterprise) settings. EAP is one of "PEAP", "TTLS" or "TLS",
+	// certificates and keys are PEM encoded. The server is validated against CACert and/or
+	// DomainSuffixMatch, one of which is required unless NoServerValidation is set.
+	EAP                string `json:"eap,omitempty"`
+	Identity           string `json:"identity,omitempty"`
+	AnonymousIdentity  string `json:"anonymousIdentity,omitempty"`
+	Password           string `json:"password,omitempty"`
+	Phase2             string `json:"phase2,omitempty"`
+	CACert             string `json:"caCert,omitempty"`
+	DomainSuffixMatch  string `json:"domainSuffixMatch,omitempty"`
+	NoServerValidation bool   `json:"noServerValidation,omitempty"`
+	ClientCert         string `json:"clientCert,omitempty"`
+	PrivateKey         string `json:"privateKey,omitempty"`
+	PrivateKeyPassword string `json:"privateKeyPassword,omitempty"`
+
+	// optional ip configuration for wlan0, kept for later networks too
+	IPConfig *IPConfig `json:"ipConfig,omitempty"`
 }
 
-const WLANInterfaceTemplate = "iface wlan0 inet dhcp\n"
+// IsEnterprise returns true if the credentials describe an 802.1X network
+func (c *WifiCredentials) IsEnterprise() bool {
+	return c.EAP != "" || c.Security == WifiSecurityEnterprise
+}
+
+// ValidatesServer returns true if an 802.1X network's server certificate will be checked
+func (c *WifiCredentials) ValidatesServer() bool {
+	return c.CACert != "" || c.DomainSuffixMatch != ""
+}
+
+// String avoids leaking secrets into the logs when the credentials are printed
+func (c WifiCredentials) String() string {
+	if c.IsEnterprise() {
+		return fmt.Sprintf("{ssid: %s eap: %s identity: %s phase2: %s}", c.SSID, c.EAP, c.Identity, c.Phase2)
+	}
+	return fmt.Sprintf("{ssid: %s}", c.SSID)
+}
+
+// parameters of get_visible_wifi_networks
+type ScanRequest struct {
+	MaxAge *int `json:"maxAge"` // seconds
+}
+
+// MaxAgeDuration returns the requested maximum age of cached scan results, or the default
+func (r *ScanRequest) MaxAgeDuration() time.Duration {
+	if r.MaxAge == nil || *r.MaxAge < 0 {
+		return DefaultScanMaxAge
+	}
+	return time.Duration(*r.MaxAge) * time.Second
+}
+
+// parameters of the saved network management calls
+type SavedNetworkChange struct {
+	Id       *int  `json:"id"`
+	Priority *int  `json:"priority"`
+	Enabled  *bool `json:"enabled"`
+}
+
+// missing describes the first parameter that the call needs but wasn't given, or returns "".
+// requires is the parameter needed besides the id, "priority" or "enabled" (or "" for none).
+func (c *SavedNetworkChange) missing(requires string) string {
+	switch {
+	case c.Id == nil:
+		return "a network id"
+	case requires == "priority" && c.Priority == nil:
+		return "a priority"
+	case requires == "enabled" && c.Enabled == nil:
+		return "enabled"
+	}
+	return ""
+}
+
+// parameters of set_country
+type CountryRequest struct {
+	Country string `json:"country"` // ISO 3166-1 alpha2 code, or 00
+}
+
+// parameters of wait_ap_event
+type APEventRequest struct {
+	Timeout int `json:"timeout"` // seconds
+}
+
+// the longest wait_ap_event will wait for, so that it doesn't hold on to the response forever
+const MaxAPEventWait = 120 * time.Second
 
 // This is ugly... but for some reason go-ninja was only delivering the progress to one of the
 // listeners, so rpc and http need to share.
 var lastUpdateProgress map[string]interface{}
 
-func GetSetupRPCRouter(conn *ninja.Connection, wifi_manager *WifiManager, srv *gatt.Server, pairing_ui ConsolePairingUI) *JSONRPCRouter {
+func GetSetupRPCRouter(conn *ninja.Connection, wifi_manager *WifiManager, connectivity *ConnectivityMonitor, apManager *AccessPointManager, srv *gatt.Server, pairing_ui ConsolePairingUI) *JSONRPCRouter {
 
 	rpc_router := &JSONRPCRouter{}
 	rpc_router.Init()
@@ -45,17 +150,28 @@ func GetSetupRPCRouter(conn *ninja.Connection, wifi_manager *WifiManager, srv *g
 
 		pairing_ui.DisplayIcon("wifi-searching.gif")
 
-		// Before we search for wifi networks, disable any that are try-fail-ing
-		wifi_manager.DisableAllNetworks()
+		// optionally, the app can tell us how old the cached results may be
+		scan_request := new(ScanRequest)
+		if len(request.Params) > 0 {
+			request.DecodeParams(scan_request)
+		}
 
-		networks, err := iwlib.GetWirelessNetworks("wlan0")
+		scan, err := wifi_manager.ScanNetworks(scan_request.MaxAgeDuration())
 		if err == nil {
-			wifi_networks := make([]WifiNetwork, len(networks))
-			for i, network := range networks {
-				wifi_networks[i].SSID = network.SSID
-			}
+			resp <- JSONRPCResponse{"2.0", request.Id, scan.Networks, nil}
+		} else {
+			resp <- JSONRPCResponse{"2.0", request.Id, nil, &JSONRPCError{500, "Could not retrieve WiFi networks", nil}}
+		}
+
+		return resp
+	})
+
+	rpc_router.AddHandler("sphere.setup.get_hidden_wifi_networks", func(request JSONRPCRequest) chan JSONRPCResponse {
+		resp := make(chan JSONRPCResponse, 1)
 
-			resp <- JSONRPCResponse{"2.0", request.Id, wifi_networks, nil}
+		scan, err := wifi_manager.LastScan()
+		if err == nil {
+			resp <- JSONRPCResponse{"2.0", request.Id, scan.Hidden, nil}
 		} else {
 			resp <- JSONRPCResponse{"2.0", request.Id, nil, &JSONRPCError{500, "Could not retrieve WiFi networks", nil}}
 		}
@@ -74,21 +190,33 @@ func GetSetupRPCRouter(conn *ninja.Connection, wifi_manager *WifiManager, srv *g
 
 		logger.Debugf("Got wifi credentials %v", wifi_creds)
 
+		done := make(chan *ConnectResult, 1)
+		go func() {
+			done <- wifi_manager.SetCredentials(wifi_creds)
+		}()
+
 		go func() {
-			success := wifi_manager.SetCredentials(wifi_creds)
-			if success {
+			var result *ConnectResult
+			select {
+			case result = <-done:
+			case <-time.After(wifi_manager.ConnectTimeout() + ConnectResponseGrace):
+				result = connectFailed(wifi_creds.SSID, ConnectReasonTimeout, "")
+			}
+
+			if result.Success {
 				var err error
 				var path string
 				var serial_number []byte
 
-				pairing_ui.DisplayIcon("wifi-connected.gif")
+				pairing_ui.DisplayIcon(result.Icon())
 
 				path, err = exec.LookPath("sphere-serial")
 				if err == nil {
 					serial_number, err = exec.Command(path).Output()
 				}
 				if err == nil {
-					pong := JSONRPCResponse{"2.0", request.Id, string(serial_number), nil}
+					result.Serial = strings.TrimSpace(string(serial_number))
+					pong := JSONRPCResponse{"2.0", request.Id, result, nil}
 					resp <- pong
 				} else {
 					logger.Errorf("failed to obtain serial number: %v", err)
@@ -96,8 +224,8 @@ func GetSetupRPCRouter(conn *ninja.Connection, wifi_manager *WifiManager, srv *g
 				}
 
 			} else {
-				pairing_ui.DisplayIcon("wifi-failed.gif")
-				resp <- JSONRPCResponse{"2.0", request.Id, nil, &JSONRPCError{500, "Could not connect to specified WiFi network, is the key correct?", nil}}
+				pairing_ui.DisplayIcon(result.Icon())
+				resp <- JSONRPCResponse{"2.0", request.Id, nil, result.RPCError()}
 			}
 		}()
 
@@ -119,7 +247,7 @@ func GetSetupRPCRouter(conn *ninja.Connection, wifi_manager *WifiManager, srv *g
 	rpc_router.AddHandler("sphere.setup.get_wifi_ip", func(request JSONRPCRequest) chan JSONRPCResponse {
 		resp := make(chan JSONRPCResponse, 1)
 
-		ip, err := GetWlanAddress()
+		ip, err := wifi_manager.Address()
 
 		if err == nil {
 			resp <- JSONRPCResponse{"2.0", request.Id, &ip, nil}
@@ -130,6 +258,182 @@ func GetSetupRPCRouter(conn *ninja.Connection, wifi_manager *WifiManager, srv *g
 		return resp
 	})
 
+	rpc_router.AddHandler("sphere.setup.get_link_quality", func(request JSONRPCRequest) chan JSONRPCResponse {
+		resp := make(chan JSONRPCResponse, 1)
+
+		resp <- JSONRPCResponse{"2.0", request.Id, wifi_manager.LinkQuality(), nil}
+
+		return resp
+	})
+
+	rpc_router.AddHandler("sphere.setup.set_country", func(request JSONRPCRequest) chan JSONRPCResponse {
+		resp := make(chan JSONRPCResponse, 1)
+
+		country_request := new(CountryRequest)
+		if err := request.DecodeParams(country_request); err != nil || country_request.Country == "" {
+			resp <- JSONRPCResponse{"2.0", request.Id, nil, &JSONRPCError{-32602, "Invalid params, expected a country", nil}}
+			return resp
+		}
+
+		if _, err := LookupRegulatoryDomain(country_request.Country); err != nil {
+			resp <- JSONRPCResponse{"2.0", request.Id, nil, &JSONRPCError{-32602, fmt.Sprintf("%s", err), nil}}
+			return resp
+		}
+
+		go func() {
+			if domain, err := ApplyCountry(country_request.Country, wifi_manager, apManager); err == nil {
+				resp <- JSONRPCResponse{"2.0", request.Id, domain, nil}
+			} else {
+				resp <- JSONRPCResponse{"2.0", request.Id, nil, &JSONRPCError{500, fmt.Sprintf("%s", err), nil}}
+			}
+		}()
+
+		return resp
+	})
+
+	rpc_router.AddHandler("sphere.setup.get_ap_credentials", func(request JSONRPCRequest) chan JSONRPCResponse {
+		resp := make(chan JSONRPCResponse, 1)
+
+		// the router is only reachable over the authenticated BLE channel, so this doesn't leak the key
+		resp <- JSONRPCResponse{"2.0", request.Id, apManager.Credentials(), nil}
+
+		return resp
+	})
+
+	rpc_router.AddHandler("sphere.setup.get_firewall_policy", func(request JSONRPCRequest) chan JSONRPCResponse {
+		resp := make(chan JSONRPCResponse, 1)
+
+		policy, rules, err := apManager.FirewallPolicy()
+		if err != nil {
+			resp <- JSONRPCResponse{"2.0", request.Id, nil, &JSONRPCError{500, fmt.Sprintf("%s", err), nil}}
+			return resp
+		}
+
+		described := make([]string, len(rules))
+		for i, rule := range rules {
+			described[i] = rule.String()
+		}
+
+		resp <- JSONRPCResponse{"2.0", request.Id, map[string]interface{}{
+			"preset":     policy.Preset,
+			"interfaces": policy.Interfaces,
+			"rules":      described,
+		}, nil}
+
+		return resp
+	})
+
+	rpc_router.AddHandler("sphere.setup.list_ap_clients", func(request JSONRPCRequest) chan JSONRPCResponse {
+		resp := make(chan JSONRPCResponse, 1)
+
+		clients, err := apManager.ListClients()
+		if err == nil {
+			resp <- JSONRPCResponse{"2.0", request.Id, clients, nil}
+		} else {
+			resp <- JSONRPCResponse{"2.0", request.Id, nil, &JSONRPCError{500, "Could not list access point clients", nil}}
+		}
+
+		return resp
+	})
+
+	// a long poll, as there is no way to push to the app. returns null if nothing happened in time.
+	rpc_router.AddHandler("sphere.setup.wait_ap_event", func(request JSONRPCRequest) chan JSONRPCResponse {
+		resp := make(chan JSONRPCResponse, 1)
+
+		wait := MaxAPEventWait
+		event_request := new(APEventRequest)
+		if err := request.DecodeParams(event_request); err == nil && event_request.Timeout > 0 {
+			if requested := time.Duration(event_request.Timeout) * time.Second; requested < wait {
+				wait = requested
+			}
+		}
+
+		events := apManager.SubscribeStations(SubscribeOptions{Buffer: 1, Policy: DropNewest})
+		go func() {
+			defer events.Unsubscribe()
+
+			select {
+			case s := <-events.C:
+				event, _ := ParseAPEvent(s)
+				resp <- JSONRPCResponse{"2.0", request.Id, event, nil}
+			case <-time.After(wait):
+				resp <- JSONRPCResponse{"2.0", request.Id, nil, nil}
+			}
+		}()
+
+		return resp
+	})
+
+	rpc_router.AddHandler("sphere.setup.get_hotspot", func(request JSONRPCRequest) chan JSONRPCResponse {
+		resp := make(chan JSONRPCResponse, 1)
+
+		resp <- JSONRPCResponse{"2.0", request.Id, apManager.Hotspot(), nil}
+
+		return resp
+	})
+
+	rpc_router.AddHandler("sphere.setup.get_uplink", func(request JSONRPCRequest) chan JSONRPCResponse {
+		resp := make(chan JSONRPCResponse, 1)
+
+		resp <- JSONRPCResponse{"2.0", request.Id, connectivity.Uplink(), nil}
+
+		return resp
+	})
+
+	rpc_router.AddHandler("sphere.setup.get_ip_config", func(request JSONRPCRequest) chan JSONRPCResponse {
+		resp := make(chan JSONRPCResponse, 1)
+
+		resp <- JSONRPCResponse{"2.0", request.Id, LoadIPConfig(), nil}
+
+		return resp
+	})
+
+	rpc_router.AddHandler("sphere.setup.set_ip_config", func(request JSONRPCRequest) chan JSONRPCResponse {
+		resp := make(chan JSONRPCResponse, 1)
+
+		ip_config := new(IPConfig)
+		if err := request.DecodeParams(ip_config); err != nil {
+			resp <- JSONRPCResponse{"2.0", request.Id, nil, &JSONRPCError{-32602, "Invalid params, expected an ip configuration", nil}}
+			return resp
+		}
+
+		go func() {
+			if err := ApplyIPConfig(ip_config); err == nil {
+				resp <- JSONRPCResponse{"2.0", request.Id, true, nil}
+			} else {
+				resp <- JSONRPCResponse{"2.0", request.Id, nil, &JSONRPCError{500, fmt.Sprintf("%s", err), nil}}
+			}
+		}()
+
+		return resp
+	})
+
+	rpc_router.AddHandler("sphere.setup.list_saved_networks", func(request JSONRPCRequest) chan JSONRPCResponse {
+		resp := make(chan JSONRPCResponse, 1)
+
+		networks, err := wifi_manager.ListSavedNetworks()
+
+		if err == nil {
+			resp <- JSONRPCResponse{"2.0", request.Id, networks, nil}
+		} else {
+			resp <- JSONRPCResponse{"2.0", request.Id, nil, &JSONRPCError{500, fmt.Sprintf("%s", err), nil}}
+		}
+
+		return resp
+	})
+
+	rpc_router.AddHandler("sphere.setup.forget_network", savedNetworkHandler("", func(change *SavedNetworkChange) error {
+		return wifi_manager.ForgetNetwork(*change.Id)
+	}))
+
+	rpc_router.AddHandler("sphere.setup.set_network_priority", savedNetworkHandler("priority", func(change *SavedNetworkChange) error {
+		return wifi_manager.SetNetworkPriority(*change.Id, *change.Priority)
+	}))
+
+	rpc_router.AddHandler("sphere.setup.enable_network", savedNetworkHandler("enabled", func(change *SavedNetworkChange) error {
+		return wifi_manager.EnableNetwork(*change.Id, *change.Enabled)
+	}))
+
 	if !factoryReset {
 
 		updateService := conn.GetServiceClient("$node/" + config.Serial() + "/updates")
@@ -217,3 +521,29 @@ func GetSetupRPCRouter(conn *ninja.Connection, wifi_manager *WifiManager, srv *g
 
 	return rpc_router
 }
+
+// savedNetworkHandler decodes a SavedNetworkChange and applies it, replying with true on success.
+// requires is the parameter the call needs besides the id, see SavedNetworkChange.missing.
+func savedNetworkHandler(requires string, apply func(change *SavedNetworkChange) error) JSONRPCFunction {
+	return func(request JSONRPCRequest) chan JSONRPCResponse {
+		resp := make(chan JSONRPCResponse, 1)
+
+		change := new(SavedNetworkChange)
+		if err := request.DecodeParams(change); err != nil {
+			resp <- JSONRPCResponse{"2.0", request.Id, nil, &JSONRPCError{-32602, "Invalid params, expected a network id", nil}}
+			return resp
+		}
+		if missing := change.missing(requires); missing != "" {
+			resp <- JSONRPCResponse{"2.0", request.Id, nil, &JSONRPCError{-32602, "Invalid params, expected " + missing, nil}}
+			return resp
+		}
+
+		if err := apply(change); err == nil {
+			resp <- JSONRPCResponse{"2.0", request.Id, true, nil}
+		} else {
+			resp <- JSONRPCResponse{"2.0", request.Id, nil, &JSONRPCError{500, fmt.Sprintf("%s", err), nil}}
+		}
+
+		return resp
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import "strings"
+
+// networkSnapshot records which networks were enabled, and which one we were connected to,
+// before a credential change.
+type networkSnapshot struct {
+	enabled []int
+	current int // -1 if we weren't connected
+}
+
+func (m *WifiManager) snapshotNetworks() *networkSnapshot {
+	snapshot := &networkSnapshot{current: -1}
+
+	networks, err := m.Backend.ListNetworks()
+	if err != nil {
+		logger.Warningf("snapshotNetworks: failed to list networks: %v", err)
+		return snapshot
+	}
+
+	for _, id := range networks {
+		if disabled, _ := m.Backend.GetNetworkSetting(id, "disabled"); disabled != "1" {
+			snapshot.enabled = append(snapshot.enabled, id)
+		}
+	}
+
+	if status, err := m.Status(); err == nil && status["wpa_state"] == "COMPLETED" {
+		if id, ok := statusInt(status, "id"); ok {
+			snapshot.current = id
+		}
+	}
+
+	return snapshot
+}
+
+// beginCredentialChange returns the networks to restore should the change fail
+func (m *WifiManager) beginCredentialChange() *networkSnapshot {
+	snapshot := m.snapshotNetworks()
+	logger.Infof("Enabled networks before credential change: %v (current %d)", snapshot.enabled, snapshot.current)
+	return snapshot
+}
+
+// rollbackCredentialChange removes the failed network, re-enables the networks in the snapshot and
+// waits for them to get us back online, recording the outcome in the result.
+func (m *WifiManager) rollbackCredentialChange(snapshot *networkSnapshot, failed int, result *ConnectResult) {
+	if failed >= 0 {
+		logger.Infof("Rollback: removing failed network %d", failed)
+		if err := m.Backend.RemoveNetwork(failed); err != nil {
+			logger.Warningf("Rollback: failed to remove network %d: %v", failed, err)
+		}
+	}
+
+	if len(snapshot.enabled) == 0 {
+		logger.Infof("Rollback: no networks to restore")
+		m.Backend.SaveConfiguration()
+		return
+	}
+
+	states := m.SubscribeState(SubscribeOptions{Buffer: 32, Policy: DropOldest, NoReplay: true})
+	defer states.Unsubscribe()
+
+	// selecting disables all the others, so select first then enable the rest
+	if snapshot.current >= 0 {
+		m.Backend.SelectNetwork(snapshot.current)
+	}
+	for _, id := range snapshot.enabled {
+		if err := m.Backend.EnableNetwork(id); err != nil {
+			logger.Warningf("Rollback: failed to enable network %d: %v", id, err)
+		}
+	}
+	m.Backend.SaveConfiguration()
+	if snapshot.current < 0 {
+		m.Backend.ReloadConfiguration()
+	}
+
+	logger.Infof("Rollback: restored networks %v, waiting to get back online", snapshot.enabled)
+
+	if restored := m.waitForConnection("", states.C); restored.Success {
+		result.Restored = true
+		if status, err := m.Status(); err == nil {
+			result.RestoredSSID = strings.Trim(status["ssid"], "\"")
+		}
+		logger.Infof("Rollback: back online with %s", result.RestoredSSID)
+	} else {
+		logger.Warningf("Rollback: previous networks did not come back: %v", restored)
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"strings"
+	"time"
+)
+
+// wpa_supplicant gives up on push button configuration after the 120s walk time, we allow a little longer
+const WPSTimeout = time.Second * 130
+
+// ConnectWPS starts WPS push button configuration, and waits for the network that the router
+// provides to get us online. Like SetCredentials, a failure restores the networks that were
+// enabled before.
+func (m *WifiManager) ConnectWPS() *ConnectResult {
+	wps := m.beginWPS()
+	if wps == nil {
+		return connectFailed("", ConnectReasonWPSFailed, "push button configuration is already in progress")
+	}
+	defer m.endWPS()
+
+	logger.Infof("ConnectWPS: Starting push button configuration")
+
+	if err := WriteWLANInterfaces(LoadIPConfig()); err != nil {
+		logger.Errorf("ConnectWPS: Failed to write %s: %v", WLANInterfacesFile, err)
+	}
+
+	states := m.SubscribeState(SubscribeOptions{Buffer: 32, Policy: DropOldest, NoReplay: true})
+	defer states.Unsubscribe()
+
+	// wpa_supplicant adds the network itself, so remember which networks already existed
+	existing, _ := m.Backend.ListNetworks()
+	snapshot := m.beginCredentialChange()
+
+	if err := m.Backend.StartWPS(); err != nil {
+		logger.Errorf("ConnectWPS: Failed to start push button configuration: %v", err)
+		return connectFailed("", ConnectReasonWPSFailed, err.Error())
+	}
+
+	var result *ConnectResult
+
+	select {
+	case event := <-wps:
+		logger.Infof("ConnectWPS: %s", event)
+		switch event {
+		case "WPS-SUCCESS":
+			result = m.waitForConnection("", states.C)
+		case "WPS-TIMEOUT":
+			result = connectFailed("", ConnectReasonWPSTimeout, "")
+		case "WPS-OVERLAP-DETECTED":
+			m.Backend.CancelWPS()
+			result = connectFailed("", ConnectReasonWPSOverlap, "")
+		default:
+			result = connectFailed("", ConnectReasonWPSFailed, "")
+		}
+	case <-time.After(WPSTimeout):
+		m.Backend.CancelWPS()
+		result = connectFailed("", ConnectReasonWPSTimeout, "")
+	}
+
+	added := m.addedNetwork(existing)
+	if added >= 0 {
+		ssid, _ := m.Backend.GetNetworkSetting(added, "ssid")
+		result.SSID = strings.Trim(ssid, "\"")
+	}
+
+	if !result.Success && result.Reason != ConnectReasonCaptivePortal {
+		states.Unsubscribe()
+		m.rollbackCredentialChange(snapshot, added, result)
+		logger.Infof("ConnectWPS: %v", result)
+		return result
+	}
+
+	// wpa_supplicant only saves the new network itself if update_config is set, so make sure of it
+	m.Backend.SaveConfiguration()
+
+	logger.Infof("ConnectWPS: %v", result)
+	return result
+}
+
+// beginWPS returns the channel that will receive the WPS-* events, or nil if push button
+// configuration is already in progress
+func (m *WifiManager) beginWPS() <-chan string {
+	m.wpsLock.Lock()
+	defer m.wpsLock.Unlock()
+	if m.wps != nil {
+		return nil
+	}
+	m.wps = make(chan string, 4)
+	return m.wps
+}
+
+func (m *WifiManager) endWPS() {
+	m.wpsLock.Lock()
+	defer m.wpsLock.Unlock()
+	m.wps = nil
+}
+
+// wpsEvent hands a WPS-* event to ConnectWPS, if it is waiting for one
+func (m *WifiManager) wpsEvent(name string) {
+	m.wpsLock.Lock()
+	defer m.wpsLock.Unlock()
+	if m.wps == nil {
+		return
+	}
+	select {
+	case m.wps <- name:
+	default:
+	}
+}
+
+// addedNetwork returns the id of a network that isn't one of the existing ones, or -1
+func (m *WifiManager) addedNetwork(existing []int) int {
+	networks, err := m.Backend.ListNetworks()
+	if err != nil {
+		return -1
+	}
+	known := make(map[int]bool)
+	for _, id := range existing {
+		known[id] = true
+	}
+	for _, id := range networks {
+		if !known[id] {
+			return id
+		}
+	}
+	return -1
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// variables rather than constants so that the tests can keep them out of /etc and /data
+var (
+	// ifupdown configuration for wlan0, brought up by ifplugd when wlan0 associates
+	WLANInterfacesFile = "/etc/network/interfaces.d/wlan0"
+	// the ip configuration chosen by the user, kept so that later credential changes don't lose it
+	WLANIPConfigFile = "/data/etc/wlan0-ip.json"
+)
+
+const (
+	IPMethodDHCP   = "dhcp"
+	IPMethodStatic = "static"
+)
+
+// IPConfig is the ipv4 configuration of wlan0
+type IPConfig struct {
+	Method  string   `json:"method"`
+	Address string   `json:"address,omitempty"`
+	Netmask string   `json:"netmask,omitempty"`
+	Gateway string   `json:"gateway,omitempty"`
+	DNS     []string `json:"dns,omitempty"`
+}
+
+func (c *IPConfig) Validate() error {
+	switch c.Method {
+	case IPMethodDHCP:
+	case IPMethodStatic:
+		if ip := net.ParseIP(c.Address); ip == nil || ip.To4() == nil {
+			return fmt.Errorf("invalid address: %s", c.Address)
+		}
+		if mask := net.ParseIP(c.Netmask); mask == nil || mask.To4() == nil {
+			return fmt.Errorf("invalid netmask: %s", c.Netmask)
+		}
+		if c.Gateway != "" {
+			if ip := net.ParseIP(c.Gateway); ip == nil || ip.To4() == nil {
+				return fmt.Errorf("invalid gateway: %s", c.Gateway)
+			}
+		}
+	default:
+		return fmt.Errorf("unknown ip method: %s", c.Method)
+	}
+
+	for _, server := range c.DNS {
+		if net.ParseIP(server) == nil {
+			return fmt.Errorf("invalid dns server: %s", server)
+		}
+	}
+
+	return nil
+}
+
+// Render produces the ifupdown stanza for the interface
+func (c *IPConfig) Render(iface string) string {
+	s := ""
+	if c.Method == IPMethodStatic {
+		s += "iface " + iface + " inet static\n"
+		s += "\taddress " + c.Address + "\n"
+		s += "\tnetmask " + c.Netmask + "\n"
+		if c.Gateway != "" {
+			s += "\tgateway " + c.Gateway + "\n"
+		}
+	} else {
+		s += "iface " + iface + " inet dhcp\n"
+	}
+	if len(c.DNS) > 0 {
+		s += "\tdns-nameservers " + strings.Join(c.DNS, " ") + "\n"
+	}
+	return s
+}
+
+// LoadIPConfig returns the saved configuration, or dhcp if there isn't one
+func LoadIPConfig() *IPConfig {
+	cfg := &IPConfig{Method: IPMethodDHCP}
+
+	data, err := ioutil.ReadFile(WLANIPConfigFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logger.Warningf("Failed to read %s, using dhcp: %v", WLANIPConfigFile, err)
+		}
+		return cfg
+	}
+
+	if err := json.Unmarshal(data, cfg); err != nil || cfg.Validate() != nil {
+		logger.Warningf("Ignoring invalid ip configuration in %s", WLANIPConfigFile)
+		return &IPConfig{Method: IPMethodDHCP}
+	}
+
+	return cfg
+}
+
+// SaveIPConfig validates and stores the configuration, and renders it into the interfaces file
+func SaveIPConfig(cfg *IPConfig) error {
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(cfg)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(WLANIPConfigFile, data, 0644); err != nil {
+		return err
+	}
+
+	return WriteWLANInterfaces(cfg)
+}
+
+func WriteWLANInterfaces(cfg *IPConfig) error {
+	return WriteToFile(WLANInterfacesFile, cfg.Render(WirelessNetworkInterface))
+}
+
+// ApplyIPConfig saves the configuration and restarts wlan0 so that it takes effect immediately
+func ApplyIPConfig(cfg *IPConfig) error {
+	if err := SaveIPConfig(cfg); err != nil {
+		return err
+	}
+
+	logger.Infof("Applying %s ip configuration to %s", cfg.Method, WirelessNetworkInterface)
+
+	// ifdown fails if the interface wasn't up, which is fine
+	exec.Command("/sbin/ifdown", WirelessNetworkInterface).Run()
+	if out, err := exec.Command("/sbin/ifup", WirelessNetworkInterface).CombinedOutput(); err != nil {
+		return fmt.Errorf("ifup %s failed: %v %s", WirelessNetworkInterface, err, out)
+	}
+
+	return nil
+}